@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+)
+
+// annotateBytes returns what each byte of a save is, following the layout
+// described on parseBytes. It doesn't validate the bytes, so it can be used
+// to look at a save that won't parse: it follows the line counts as far as
+// the data goes, and anything past where the counts say the save ends is
+// marked unexpected.
+func annotateBytes(data []byte) []string {
+	roles := make([]string, len(data))
+
+	set := func(i int, role string) bool {
+		if i >= len(data) {
+			return false
+		}
+
+		roles[i] = role
+
+		return true
+	}
+
+	set(0, "magic byte")
+	set(1, "program number, hundreds")
+	set(2, "program number, tens")
+	set(3, "program number, ones")
+
+	set(4, "channel 1 line count, high byte")
+
+	if !set(5, "channel 1 line count, low byte") {
+		return fillUnexpected(roles)
+	}
+
+	channel1LineCount := lineCountAt(data, 4)
+	annotateLines(data, roles, 1, 6, channel1LineCount)
+
+	channel1End := 6 + channel1LineCount
+	set(channel1End, "channel 1 checksum")
+	set(channel1End+1, "total line count, high byte")
+
+	if !set(channel1End+2, "total line count, low byte") {
+		return fillUnexpected(roles)
+	}
+
+	totalLineCount := lineCountAt(data, channel1End+1)
+	channel2LineCount := totalLineCount - channel1LineCount
+
+	if channel2LineCount < 0 {
+		return fillUnexpected(roles)
+	}
+
+	annotateLines(data, roles, 2, channel1End+3, channel2LineCount)
+	set(channel1End+3+channel2LineCount, "channel 2 checksum")
+
+	return fillUnexpected(roles)
+}
+
+// annotateLines sets the roles of a channel's lines, which start at offset
+// start.
+func annotateLines(data []byte, roles []string, channel, start, lineCount int) {
+	for i := 0; i < lineCount && start+i < len(data); i++ {
+		offset := start + i
+
+		if data[offset] == barByte {
+			roles[offset] = fmt.Sprintf("channel %d line %d, bar", channel, i)
+			continue
+		}
+
+		roles[offset] = fmt.Sprintf("channel %d line %d, step length %d", channel, i, data[offset])
+
+		if i+1 < lineCount && offset+1 < len(data) {
+			roles[offset+1] = fmt.Sprintf("channel %d line %d, gate length %d", channel, i+1, data[offset+1])
+		}
+
+		if i+2 < lineCount && offset+2 < len(data) {
+			roles[offset+2] = fmt.Sprintf("channel %d line %d, %s", channel, i+2, describeNoteByte(data[offset+2]))
+		}
+
+		i += 2
+	}
+}
+
+// describeNoteByte describes a note byte: its note and the flags set on it.
+func describeNoteByte(b byte) string {
+	noteNum := int(b & noteNumMask)
+
+	description := fmt.Sprintf("note %d", noteNum)
+	if note, ok := noteMap[noteNum]; ok {
+		description = fmt.Sprintf("note %d (%s%d)", noteNum, note.NoteName, note.Octave)
+	} else {
+		description += " (out of range)"
+	}
+
+	if b&portamentoMask != 0 {
+		description += ", portamento"
+	}
+
+	if b&accentMask != 0 {
+		description += ", accent"
+	}
+
+	return description
+}
+
+// fillUnexpected marks every byte without a role as unexpected.
+func fillUnexpected(roles []string) []string {
+	for i, role := range roles {
+		if role == "" {
+			roles[i] = "unexpected"
+		}
+	}
+
+	return roles
+}
+
+// printAnnotated prints the bytes of a save as a table, one byte per row with
+// what it is.
+func printAnnotated(data []byte) {
+	fmt.Println("offset  hex  dec  contents")
+
+	for i, role := range annotateBytes(data) {
+		fmt.Printf("%6d  %02X   %3d  %s\n", i, data[i], data[i], role)
+	}
+
+	fmt.Println()
+}
+
+// printNoteTable prints every note the MC-202 can store with its note number,
+// the note byte it's saved as, its name, and its pitch and control voltage,
+// for looking up the notes in a byte dump. Accent adds 0x40 to the note byte
+// and portamento adds 0x80. With flats the black keys are spelled as flats.
+func printNoteTable(flats bool) {
+	fmt.Println("num  hex  note  freq (Hz)  CV (V)")
+
+	for i := MinNote; i <= MaxNote; i++ {
+		note := noteMap[i]
+
+		name := note.NoteName
+		if flats {
+			name = flatNoteNames[i%12]
+		}
+
+		fmt.Printf("%3d  %02X   %-4s  %9.2f  %6.3f\n", i, i, fmt.Sprintf("%s%d", name, note.Octave), note.Frequency(), note.CV())
+	}
+}
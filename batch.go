@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestName is the name of the file a batch job keeps its progress in,
+// inside the directory being processed.
+const manifestName = ".mc-202-librarian-manifest.json"
+
+// manifest records which files of a batch job have been processed, so an
+// interrupted job can pick up where it left off.
+type manifest struct {
+	Files map[string]manifestEntry `json:"files"`
+}
+
+// manifestEntry is the outcome of processing one file: the output it produced
+// or the error that stopped it.
+type manifestEntry struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readManifest reads the manifest in dir, returning an empty one if the
+// directory hasn't been processed before.
+func readManifest(dir string) (*manifest, error) {
+	m := &manifest{Files: make(map[string]manifestEntry)}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("problem reading manifest: %w", err)
+	}
+
+	if m.Files == nil {
+		m.Files = make(map[string]manifestEntry)
+	}
+
+	return m, nil
+}
+
+// write saves the manifest to dir.
+func (m *manifest) write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, manifestName), data, 0644)
+}
+
+// skip reports whether a file should be skipped on this run. Files that
+// succeeded are skipped unless overwrite is set; with retryFailed, only files
+// that previously failed are processed.
+func (m *manifest) skip(name string, overwrite, retryFailed bool) bool {
+	entry, ok := m.Files[name]
+
+	if retryFailed {
+		return !ok || entry.Error == ""
+	}
+
+	return ok && entry.Error == "" && !overwrite
+}
+
+// listFiles returns the names of the files in dir with the given extension,
+// sorted. The manifest is never included.
+func listFiles(dir, ext string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == manifestName || !strings.EqualFold(filepath.Ext(entry.Name()), ext) {
+			continue
+		}
+
+		names = append(names, entry.Name())
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// batchDecode decodes every wav file in dir to a JSON file alongside it,
+// recording progress in the directory's manifest after every file.
+func batchDecode(dir string, opts decodeOptions, overwrite, retryFailed bool) error {
+	// the files are decoded one after another, so the one worker reuses one
+	// Decoder's buffers for all of them
+	opts.buffers = NewDecoder()
+
+	return runBatch(dir, ".wav", "decoded", overwrite, retryFailed, func(name string) (string, error) {
+		output := strings.TrimSuffix(name, filepath.Ext(name)) + ".json"
+
+		return output, decodeToJSON(filepath.Join(dir, name), filepath.Join(dir, output), opts)
+	})
+}
+
+// batchEncode encodes every JSON file in dir to a wav file in its encoded
+// directory, recording progress in the directory's manifest after every file.
+func batchEncode(dir string, channels int, opts encodeOptions, overwrite, retryFailed bool) error {
+	if err := os.MkdirAll(filepath.Join(dir, "encoded"), 0755); err != nil {
+		return err
+	}
+
+	return runBatch(dir, ".json", "encoded", overwrite, retryFailed, func(name string) (string, error) {
+		output := filepath.Join("encoded", strings.TrimSuffix(name, filepath.Ext(name))+".wav")
+
+		return output, encodeToWav(filepath.Join(dir, name), filepath.Join(dir, output), channels, opts)
+	})
+}
+
+// runBatch calls process for every file in dir with the given extension that
+// the manifest says still needs processing, and prints a summary at the end.
+// process returns the name of the output it wrote, relative to dir.
+func runBatch(dir, ext, verb string, overwrite, retryFailed bool, process func(name string) (string, error)) error {
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	names, err := listFiles(dir, ext)
+	if err != nil {
+		return err
+	}
+
+	var succeeded, failed, skipped int
+
+	for _, name := range names {
+		if m.skip(name, overwrite, retryFailed) {
+			skipped++
+			continue
+		}
+
+		if output, err := process(name); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			m.Files[name] = manifestEntry{Error: err.Error()}
+			failed++
+		} else {
+			logf("%s: %s\n", name, output)
+			m.Files[name] = manifestEntry{Output: output}
+			succeeded++
+		}
+
+		if err := m.write(dir); err != nil {
+			return fmt.Errorf("problem writing manifest: %w", err)
+		}
+	}
+
+	logf("%d %s, %d failed, %d skipped\n", succeeded, verb, failed, skipped)
+
+	return nil
+}
+
+// decodeToJSON decodes a wav file and writes the sequence to a JSON file.
+func decodeToJSON(fileName, outName string, opts decodeOptions) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sequence, err := decodeSequence(context.Background(), f, opts)
+	if err != nil {
+		return err
+	}
+
+	return opts.writeJSON(outName, sequence)
+}
+
+// encodeToWav encodes a JSON sequence file to a wav file, recomputing the line
+// counts and checksums from the notes.
+func encodeToWav(fileName, outName string, channels int, opts encodeOptions) error {
+	sequence, err := opts.loadSequence(fileName)
+	if err != nil {
+		return err
+	}
+
+	data, err := opts.encodeSequence(sequence, channels)
+	if err != nil {
+		return err
+	}
+
+	label := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+
+	return writeSequenceWav(outName, data, opts, sequenceMetadata(sequence.ProgramNumber, label))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+// bitsImageMargin is the width in pixels of the strip down the left of a bits
+// image that marks the rows each decoded byte was read from.
+const bitsImageMargin = 4
+
+// The colours of a bits image: sign changes are black on white, and the rows
+// of each decoded byte are marked in red or blue, alternating so neighbouring
+// bytes can be told apart.
+var bitsImagePalette = color.Palette{
+	color.White,
+	color.Black,
+	color.RGBA{R: 0xd0, A: 0xff},
+	color.RGBA{B: 0xd0, A: 0xff},
+}
+
+// writeBitsImage writes the decode's sign change bits to a PNG file as a
+// raster with a row for each bit period, one pixel to a frame. A one bit has
+// twice as many sign changes as a zero, so runs of ones and zeros show as
+// bands of different density, a dropout as a gap, and the tape speed
+// wandering as the bands slanting. Down the left, the rows each decoded byte
+// was read from, its start bit to its stop bits, are marked, so a glitch can
+// be matched to the byte it's in. If the bytes weren't read from one place in
+// the recording, such as when takes were reconciled, the marks are left off.
+func writeBitsImage(fileName string, result *DecodeResult) error {
+	bits, framesPerBit := result.SignBits, result.FramesPerBit
+
+	rows := (len(bits) + framesPerBit - 1) / framesPerBit
+
+	img := image.NewPaletted(image.Rect(0, 0, bitsImageMargin+framesPerBit, rows), bitsImagePalette)
+
+	for i, bit := range bits {
+		if bit == 1 {
+			img.SetColorIndex(bitsImageMargin+i%framesPerBit, i/framesPerBit, 1)
+		}
+	}
+
+	for i, offset := range result.Offsets {
+		colour := uint8(2 + i%2)
+
+		for row := offset / framesPerBit; row < min(rows, (offset+11*framesPerBit)/framesPerBit); row++ {
+			for x := 0; x < bitsImageMargin-1; x++ {
+				img.SetColorIndex(x, row, colour)
+			}
+		}
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
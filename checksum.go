@@ -0,0 +1,85 @@
+package main
+
+import "fmt"
+
+// checksumByte returns the checksum byte for a channel whose line count bytes
+// and lines sum to sum.
+//
+// The MC-202 adds up a channel's bytes as signed 8-bit values, letting the
+// sum wrap around, and stores the byte that brings the total back to zero.
+// Since the sum wraps, only its low eight bits matter, and signed and unsigned
+// addition give the same bits; the checksum byte is the two's complement of
+// the sum, its bits inverted plus one. Negating an int8 does exactly that,
+// including for -128, which wraps back to -128: 0x80 + 0x80 is 0x100, which
+// is zero in eight bits. A sum of zero has a checksum byte of zero.
+func checksumByte(sum int8) byte {
+	return byte(-sum)
+}
+
+// checksum returns the checksum byte for a channel's line count bytes and
+// lines.
+func checksum(data []byte) byte {
+	var sum int8
+
+	for _, b := range data {
+		sum += int8(b)
+	}
+
+	return checksumByte(sum)
+}
+
+// explainChecksums prints each channel's checksum being worked out: the
+// running int8 sum after every byte, the checksum that sum calls for and the
+// checksum byte that was stored.
+func explainChecksums(data []byte) error {
+	if len(data) < 10 {
+		return fmt.Errorf("%w: %d", ErrTooFewBytes, len(data))
+	}
+
+	channel1LineCount := lineCountAt(data, 4)
+	channel1End := 6 + channel1LineCount
+
+	if channel1End+3 > len(data) {
+		return fmt.Errorf("%w for channel 1 line count: %d", ErrTooFewBytes, len(data))
+	}
+
+	totalLineCount := lineCountAt(data, channel1End+1)
+	channel2End := 6 + totalLineCount + 3
+
+	if channel2End < channel1End+3 || channel2End >= len(data) {
+		return fmt.Errorf("%w for channel 2 line count: %d", ErrTooFewBytes, len(data))
+	}
+
+	explainChecksum(1, data, 4, channel1End)
+	explainChecksum(2, data, channel1End+1, channel2End)
+
+	return nil
+}
+
+// explainChecksum prints the working for the checksum of data[start:end],
+// which is stored in data[end].
+func explainChecksum(channel int, data []byte, start, end int) {
+	fmt.Printf("Channel %d\n", channel)
+	fmt.Println()
+	fmt.Println("offset  byte  as int8  running sum")
+
+	var sum int8
+
+	for i := start; i < end; i++ {
+		sum += int8(data[i])
+		fmt.Printf("%6d  %02X    %7d  %11d\n", i, data[i], int8(data[i]), sum)
+	}
+
+	computed := checksum(data[start:end])
+
+	fmt.Println()
+	fmt.Printf("The running sum is %d, so the checksum is its two's complement, %d (%02X).\n", sum, int8(computed), computed)
+
+	if data[end] == computed {
+		fmt.Printf("The stored checksum at offset %d is %02X, which matches.\n", end, data[end])
+	} else {
+		fmt.Printf("The stored checksum at offset %d is %02X, which DOES NOT match.\n", end, data[end])
+	}
+
+	fmt.Println()
+}
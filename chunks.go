@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// dataChunk finds the data chunk of a wav file by walking its chunks, and
+// returns where the chunk's samples start, the size the chunk declares and
+// the number of bytes actually left in the file from there. It leaves r where
+// it found it, so it can be used alongside a wav.Decoder reading r.
+func dataChunk(r io.ReadSeeker) (offset, declared, available int64, err error) {
+	position, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer r.Seek(position, io.SeekStart)
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// skip the RIFF header and the WAVE form type
+	offset = 12
+
+	header := make([]byte, 8)
+
+	for offset+8 <= size {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return 0, 0, 0, err
+		}
+
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, 0, 0, err
+		}
+
+		chunkSize := int64(binary.LittleEndian.Uint32(header[4:]))
+		offset += 8
+
+		if string(header[:4]) == "data" {
+			return offset, chunkSize, size - offset, nil
+		}
+
+		// chunks are padded to an even number of bytes
+		offset += chunkSize + chunkSize%2
+	}
+
+	return 0, 0, 0, ErrInvalidWavFile
+}
+
+// warnDataChunk prints a warning if the wav file's data chunk says it's
+// longer than what's left of the file, as it is when a recording was cut
+// short. Reading stops at the end of the file, so decoding still works on
+// whatever is there.
+func warnDataChunk(r io.ReadSeeker) {
+	_, declared, available, err := dataChunk(r)
+	if err != nil || declared <= available {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: the data chunk says it's %d bytes but the file only has %d, reading what's there\n", declared, available)
+}
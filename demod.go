@@ -0,0 +1,278 @@
+package main
+
+import "math"
+
+// Demodulator tells the byte assembler which bit each bit period of a
+// recording holds. Periods are addressed by the frame they start at, and can
+// start at any frame, since the assembler slides along a frame at a time until
+// it finds a start bit.
+type Demodulator interface {
+	// Len returns the number of frames in the recording.
+	Len() int
+	// FramesPerBit returns the number of frames in one bit period.
+	FramesPerBit() int
+	// Zero reports whether the bit period starting at frame i is a zero bit,
+	// which is also what a start bit is.
+	Zero(i int) bool
+	// One reports whether the bit period starting at frame i is a one bit.
+	// A period can be neither a zero nor a one if it's too noisy to tell.
+	One(i int) bool
+}
+
+// signChangeDemodulator is the default demodulator. It counts the sign changes
+// in a bit period: a zero bit is zeroCycles cycles of the zero frequency and a
+// one bit is oneCycles cycles of the one frequency, so there are around 4 and
+// 8 of them respectively.
+type signChangeDemodulator struct {
+	framesPerBit int
+	// counts holds the running total of sign changes before each frame, so
+	// the changes in a period can be counted without summing it.
+	counts []int32
+}
+
+// newSignChangeDemodulator returns a demodulator for the sign change bits.
+func newSignChangeDemodulator(bits []int, framesPerBit int) *signChangeDemodulator {
+	counts := make([]int32, len(bits)+1)
+
+	for i, bit := range bits {
+		counts[i+1] = counts[i] + int32(bit)
+	}
+
+	return &signChangeDemodulator{framesPerBit: framesPerBit, counts: counts}
+}
+
+func (d *signChangeDemodulator) Len() int {
+	return len(d.counts) - 1
+}
+
+func (d *signChangeDemodulator) FramesPerBit() int {
+	return d.framesPerBit
+}
+
+// changes returns the number of sign changes in the bit period starting at
+// frame i, or -1 if the recording ends before the period does.
+func (d *signChangeDemodulator) changes(i int) int {
+	if i < 0 || i+d.framesPerBit >= len(d.counts) {
+		return -1
+	}
+
+	return int(d.counts[i+d.framesPerBit] - d.counts[i])
+}
+
+func (d *signChangeDemodulator) Zero(i int) bool {
+	n := d.changes(i)
+	return n >= 0 && n <= 4
+}
+
+func (d *signChangeDemodulator) One(i int) bool {
+	return d.changes(i) >= 7
+}
+
+// goertzelZeroRatio is how many times stronger the zero frequency has to be
+// than the one frequency for a bit period to count as a zero bit. A period
+// that's partly a one bit and partly a start bit looks like a zero long before
+// it lines up with the start bit, so this is high to keep the assembler from
+// starting a byte early. goertzelMinShare is the share of a period's energy
+// that has to be at one of the two frequencies for it to count as either bit,
+// which rules out silence and broadband noise.
+const (
+	goertzelZeroRatio = 16
+	goertzelMinShare  = 0.25
+)
+
+// goertzelDemodulator measures the strength of the zero and one frequencies in
+// each bit period with the Goertzel algorithm and takes the stronger. It holds
+// up better than counting sign changes when noise pushes the signal back and
+// forth across zero.
+type goertzelDemodulator struct {
+	samples      []float64
+	framesPerBit int
+	zeroCoeff    float64
+	oneCoeff     float64
+}
+
+// newGoertzelDemodulator returns a demodulator for samples recorded at rate.
+func newGoertzelDemodulator(samples []float64, framesPerBit, rate int) *goertzelDemodulator {
+	return &goertzelDemodulator{
+		samples:      samples,
+		framesPerBit: framesPerBit,
+		zeroCoeff:    2 * math.Cos(2*math.Pi*zeroFreq/float64(rate)),
+		oneCoeff:     2 * math.Cos(2*math.Pi*oneFreq/float64(rate)),
+	}
+}
+
+func (d *goertzelDemodulator) Len() int {
+	return len(d.samples)
+}
+
+func (d *goertzelDemodulator) FramesPerBit() int {
+	return d.framesPerBit
+}
+
+// powers returns the power of the zero and one frequencies in the bit period
+// starting at frame i, or false if it holds too little of either to tell or
+// the recording ends before the period does.
+func (d *goertzelDemodulator) powers(i int) (zero, one float64, ok bool) {
+	if i < 0 || i+d.framesPerBit > len(d.samples) {
+		return 0, 0, false
+	}
+
+	period := d.samples[i : i+d.framesPerBit]
+
+	var energy float64
+	for _, sample := range period {
+		energy += sample * sample
+	}
+
+	zero = goertzel(period, d.zeroCoeff)
+	one = goertzel(period, d.oneCoeff)
+
+	// a pure tone's power is its energy times half the length of the period
+	full := energy * float64(d.framesPerBit) / 2
+
+	return zero, one, math.Max(zero, one) >= goertzelMinShare*full && full > 0
+}
+
+func (d *goertzelDemodulator) Zero(i int) bool {
+	zero, one, ok := d.powers(i)
+	return ok && zero > goertzelZeroRatio*one
+}
+
+func (d *goertzelDemodulator) One(i int) bool {
+	zero, one, ok := d.powers(i)
+	return ok && one > zero
+}
+
+// goertzel returns the power of the frequency with the given coefficient,
+// 2cos(2πf/rate), in the samples.
+func goertzel(samples []float64, coeff float64) float64 {
+	var s1, s2 float64
+
+	for _, sample := range samples {
+		s0 := sample + coeff*s1 - s2
+		s2 = s1
+		s1 = s0
+	}
+
+	return s1*s1 + s2*s2 - coeff*s1*s2
+}
+
+func (d *signChangeDemodulator) setFramesPerBit(n int) {
+	d.framesPerBit = n
+}
+
+func (d *goertzelDemodulator) setFramesPerBit(n int) {
+	d.framesPerBit = n
+}
+
+// tunableDemodulator is a demodulator whose bit period can be changed as it's
+// used.
+type tunableDemodulator interface {
+	Demodulator
+	setFramesPerBit(n int)
+}
+
+// clockTracker is implemented by demodulators that follow changes in the
+// speed of the recording. assembleBytes calls track with each run of one bits
+// it reads, the data buffer and the stop bits, whose pattern is known, and
+// reads FramesPerBit again afterwards. It also looks for each start bit a
+// little before it's expected, so the bytes stay in step with the tape as
+// well as the bit period.
+type clockTracker interface {
+	track(i, n int)
+}
+
+// maxClockDrift is the furthest the adaptive clock lets the bit period move
+// from the one for the sample rate, as a fraction of it. Anything further is
+// more likely a misreading than the tape.
+const maxClockDrift = 0.1
+
+// adaptiveClock wraps a demodulator and re-estimates the bit period from the
+// runs of one bits the assembler reads, for tapes with wow and flutter bad
+// enough that the period drifts within a sequence. It measures how fast the
+// tape is running from the spacing of the sign changes in each run, compared
+// to the one frequency, and smooths it so that one bad reading doesn't throw
+// it off.
+//
+// The bit period is rounded down: the assembler looks for each start bit from
+// where it expects it, a frame at a time, so reading a byte a little early is
+// put right by the next start bit but reading it late isn't.
+type adaptiveClock struct {
+	Demodulator
+	set  func(n int)
+	bits []int
+	// nominal is the bit period at normal speed, and halfCycle the spacing
+	// of the sign changes in the one frequency.
+	nominal   float64
+	halfCycle float64
+	// speed is how much longer than normal everything on the tape is, so
+	// 1.01 is a tape running 1% slow.
+	speed float64
+}
+
+// newAdaptiveClock returns demod, for a recording at rate, with its bit
+// period tracked from the sign change bits.
+func newAdaptiveClock(demod tunableDemodulator, bits []int, rate int) *adaptiveClock {
+	return &adaptiveClock{
+		Demodulator: demod,
+		set:         demod.setFramesPerBit,
+		bits:        bits,
+		nominal:     float64(demod.FramesPerBit()),
+		halfCycle:   float64(rate) / (2 * oneFreq),
+		speed:       1,
+	}
+}
+
+// track measures the n one bits starting at frame i. The spacings that are
+// too far from the one frequency's, such as where the run meets a start bit,
+// are left out.
+func (c *adaptiveClock) track(i, n int) {
+	end := min(i+n*c.FramesPerBit(), len(c.bits))
+	halfCycle := c.halfCycle * c.speed
+
+	var (
+		previous = -1
+		total    int
+		count    int
+	)
+
+	for j := max(i, 0); j < end; j++ {
+		if c.bits[j] != 1 {
+			continue
+		}
+
+		if previous >= 0 {
+			if spacing := float64(j - previous); spacing > halfCycle*3/4 && spacing < halfCycle*5/4 {
+				total += j - previous
+				count++
+			}
+		}
+
+		previous = j
+	}
+
+	// too few to go on
+	if count < oneCycles {
+		return
+	}
+
+	speed := float64(total) / float64(count) / c.halfCycle
+	speed = min(max(speed, 1-maxClockDrift), 1+maxClockDrift)
+
+	c.speed = 0.75*c.speed + 0.25*speed
+	c.set(int(c.nominal * c.speed))
+}
+
+// demodulatorNames are the demodulators -demod can choose from.
+var demodulatorNames = []string{"sign", "goertzel"}
+
+// newDemodulator returns the named demodulator for a recording at rate, or the
+// sign change demodulator if the name isn't known.
+func newDemodulator(name string, samples []float64, signBits []int, framesPerBit, rate int) tunableDemodulator {
+	switch name {
+	case "goertzel":
+		return newGoertzelDemodulator(samples, framesPerBit, rate)
+	default:
+		return newSignChangeDemodulator(signBits, framesPerBit)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "math"
+
+// StepToBeats converts a length in clock pulses to quarter note beats at the
+// given resolution. Pass ClockPPQN for lengths read from an MC-202.
+func StepToBeats(step int, ppqn int) float64 {
+	return float64(step) / float64(ppqn)
+}
+
+// BeatsToStep converts a length in quarter note beats to the nearest whole
+// number of clock pulses at the given resolution.
+func BeatsToStep(beats float64, ppqn int) int {
+	return int(math.Round(beats * float64(ppqn)))
+}
+
+// StepToMillis converts a length in clock pulses to milliseconds at the given
+// tempo in beats per minute.
+func StepToMillis(step int, ppqn int, bpm float64) float64 {
+	return StepToBeats(step, ppqn) * 60000 / bpm
+}
+
+// MillisToStep converts a length in milliseconds at the given tempo to the
+// nearest whole number of clock pulses.
+func MillisToStep(millis float64, ppqn int, bpm float64) int {
+	return BeatsToStep(millis*bpm/60000, ppqn)
+}
+
+// ExpectedDuration returns how long, in seconds, the wav file the sequence
+// encodes to would be at rate, with leader seconds of tone before it and
+// trailer seconds after, without generating the samples. It follows the
+// layout the encoder writes with the default options: every byte but the last
+// is a start bit, eight data bits and two stop bits, the last has a single
+// cycle in place of its stop bits, and the data buffer follows the program
+// number. Both channels' lines count towards the bytes, a note as three and a
+// bar as one.
+func ExpectedDuration(s *Sequence, rate int, leader, trailer float64) float64 {
+	ch1Notes, ch1Bars, ch2Notes, ch2Bars := s.Counts()
+
+	// the magic byte, program number, two line counts of two bytes each and
+	// two checksums
+	byteCount := 10 + 3*(ch1Notes+ch2Notes) + ch1Bars + ch2Bars
+
+	return encodedDuration(byteCount, rate, leader, trailer, defaultEncodeOptions)
+}
+
+// encodedDuration returns how long, in seconds, byteCount bytes take to
+// encode at rate with opts, including leader and trailer seconds of tone.
+// Each tone is rounded to whole frames the way generateSamples rounds it.
+func encodedDuration(byteCount, rate int, leader, trailer float64, opts encodeOptions) float64 {
+	frames := func(freq int, cycles float64) int {
+		return int(math.Round(cycles * float64(rate) / float64(freq)))
+	}
+
+	// a zero bit and a one bit round to the same number of frames at the
+	// usual rates, since the zero frequency is half the one
+	bit := frames(oneFreq, oneCycles)
+
+	total := frames(oneFreq, leader*oneFreq)
+	total += frames(oneFreq, dataBufferLength*oneCycles)
+	total += (byteCount - 1) * (9*bit + frames(oneFreq, float64(opts.stopCycles+opts.gapCycles)))
+	total += 9*bit + frames(oneFreq, 1)
+	total += frames(zeroFreq, trailer*zeroFreq)
+
+	return float64(total) / float64(rate)
+}
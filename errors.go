@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned while assembling, validating and encoding sequences. They are
+// wrapped with the details of where the problem was found, so check for them
+// with errors.Is; ChecksumError and LineError can be inspected with errors.As.
+var (
+	ErrInvalidWavFile       = errors.New("invalid wav file")
+	ErrTooShort             = errors.New("input too short to contain a sequence")
+	ErrInvalidDataBuffer    = errors.New("invalid data buffer")
+	ErrInvalidByteCount     = errors.New("invalid number of bytes")
+	ErrTruncated            = errors.New("recording ends partway through the sequence")
+	ErrTooFewBytes          = errors.New("too few bytes")
+	ErrInvalidMagicByte     = errors.New("invalid magic byte")
+	ErrInvalidProgramNumber = errors.New("invalid program number")
+	ErrInvalidLineCount     = errors.New("invalid line count")
+	ErrInvalidNoteLines     = errors.New("invalid number of note lines")
+	ErrLineCountMismatch    = errors.New("line count doesn't match the lines")
+	ErrNoteOutOfRange       = errors.New("invalid note number")
+	ErrInvalidNoteName      = errors.New("invalid note name")
+	ErrNoteNameMismatch     = errors.New("note name doesn't match the note number")
+	ErrStepOutOfRange       = errors.New("invalid step length")
+	ErrGateOutOfRange       = errors.New("invalid gate length")
+	ErrGateExceedsStep      = errors.New("gate length longer than the step length")
+	ErrChecksumMismatch     = errors.New("invalid checksum")
+	ErrInvalidChannels      = errors.New("invalid number of channels")
+	ErrInvalidTimeRange     = errors.New("invalid time range")
+	ErrInvalidShareCode     = errors.New("invalid share code")
+	ErrBoundaryMismatch     = errors.New("channel 1 line count doesn't match the channel boundary")
+	ErrEncodeMismatch       = errors.New("encoded audio doesn't decode to the bytes it was encoded from")
+	ErrNoLeaderTone         = errors.New("this doesn't look like an MC-202 tape recording")
+	ErrTooManyFalseMagic    = errors.New("too many false magic bytes")
+)
+
+// ChecksumError is returned when a channel's checksum byte doesn't cancel out
+// the sum of the channel's bytes. The program number is read and checked
+// before the checksums, so ProgramNumber is the program the bad save is for,
+// which is enough to catalogue it.
+type ChecksumError struct {
+	Channel       int
+	Stored        int8
+	Computed      int8
+	ProgramNumber int
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("validation failed - invalid channel %d checksum: byte: (%d, %02X) checksum: (%d, %02X), program %03d", e.Channel, e.Stored, byte(e.Stored), e.Computed, byte(e.Computed), e.ProgramNumber)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// TruncatedError is returned when a sequence's bytes decoded cleanly but the
+// recording ended before all of them had been read, as opposed to a recording
+// that's corrupt. Bytes holds the bytes that were read, and Expected the
+// number the line counts called for, or 0 if it ended before channel 2's line
+// count.
+type TruncatedError struct {
+	Bytes    []byte
+	Expected int
+}
+
+func (e *TruncatedError) Error() string {
+	if e.Expected == 0 {
+		return fmt.Sprintf("something went wrong: %v: read %d bytes, %d lines", ErrTruncated, len(e.Bytes), recoveredLines(e.Bytes))
+	}
+
+	return fmt.Sprintf("something went wrong: %v: read %d of %d bytes, %d lines", ErrTruncated, len(e.Bytes), e.Expected, recoveredLines(e.Bytes))
+}
+
+func (e *TruncatedError) Unwrap() error {
+	return ErrTruncated
+}
+
+// LineError is returned when a line of a channel holds a value the MC-202
+// can't store. Err is the kind of problem, such as ErrNoteOutOfRange.
+type LineError struct {
+	Err     error
+	Channel int
+	Line    int
+	Value   int
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("validation failed - %v, channel %d, line %d: %d", e.Err, e.Channel, e.Line, e.Value)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
@@ -2,9 +2,9 @@ module github.com/alexwilkerson/mc-202-librarian
 
 go 1.21.3
 
-require github.com/go-audio/wav v1.1.0
-
 require (
-	github.com/go-audio/audio v1.0.0 // indirect
-	github.com/go-audio/riff v1.0.0 // indirect
+	github.com/go-audio/audio v1.0.0
+	github.com/go-audio/wav v1.1.0
 )
+
+require github.com/go-audio/riff v1.0.0 // indirect
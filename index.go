@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// indexEntry is what the index records about one file in a directory.
+type indexEntry struct {
+	File          string `json:"file"`
+	ProgramNumber int    `json:"program_number"`
+	Channels      int    `json:"channels"`
+	Channel1Notes int    `json:"channel_1_notes"`
+	Channel2Notes int    `json:"channel_2_notes"`
+	Bars          int    `json:"bars"`
+	// Fingerprint is the sequence's Fingerprint, the same for every copy of
+	// the save in the directory.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// LowestNote and HighestNote are note names with their octave, such as
+	// C#3. TopNote is the name of the most used note in any octave, which is
+	// a rough guide to the key.
+	LowestNote  string `json:"lowest_note,omitempty"`
+	HighestNote string `json:"highest_note,omitempty"`
+	TopNote     string `json:"top_note,omitempty"`
+	// Valid is whether the file decodes with good checksums, for wav files,
+	// or encodes with the checksums it records, for JSON files.
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+var indexHeader = []string{"file", "program_number", "channels", "channel_1_notes", "channel_2_notes", "bars", "fingerprint", "lowest_note", "highest_note", "top_note", "valid", "error"}
+
+func (e indexEntry) record() []string {
+	return []string{
+		e.File,
+		strconv.Itoa(e.ProgramNumber),
+		strconv.Itoa(e.Channels),
+		strconv.Itoa(e.Channel1Notes),
+		strconv.Itoa(e.Channel2Notes),
+		strconv.Itoa(e.Bars),
+		e.Fingerprint,
+		e.LowestNote,
+		e.HighestNote,
+		e.TopNote,
+		strconv.FormatBool(e.Valid),
+		e.Error,
+	}
+}
+
+// writeIndex scans dir for wav and JSON files and writes a catalogue of them
+// to outName, as CSV if its extension is .csv and JSON otherwise. Files that
+// don't decode or load are listed with the reason, so the index covers the
+// whole directory.
+func writeIndex(dir, outName string, opts decodeOptions) error {
+	var entries []indexEntry
+
+	for _, ext := range []string{".wav", ".json"} {
+		names, err := listFiles(dir, ext)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			// the index may be being written into the directory it covers
+			if filepath.Join(dir, name) == filepath.Clean(outName) {
+				continue
+			}
+
+			entries = append(entries, indexFile(filepath.Join(dir, name), name, opts))
+		}
+	}
+
+	f, err := os.Create(outName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(outName), ".csv") {
+		w := csv.NewWriter(f)
+
+		if err := w.Write(indexHeader); err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := w.Write(entry.record()); err != nil {
+				return err
+			}
+		}
+
+		w.Flush()
+
+		return w.Error()
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "    ")
+
+	return enc.Encode(entries)
+}
+
+// indexFile returns the index entry for a wav or JSON file.
+func indexFile(fileName, name string, opts decodeOptions) indexEntry {
+	entry := indexEntry{File: name}
+
+	var (
+		sequence *Sequence
+		err      error
+	)
+
+	if strings.EqualFold(filepath.Ext(name), ".wav") {
+		sequence, err = indexWav(fileName, opts)
+	} else {
+		sequence, err = indexJSON(fileName, opts)
+	}
+
+	if sequence != nil {
+		summarizeNotes(&entry, sequence)
+	}
+
+	// a save with a bad checksum still says which program it is
+	var checksumErr *ChecksumError
+	if sequence == nil && errors.As(err, &checksumErr) {
+		entry.ProgramNumber = checksumErr.ProgramNumber
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	entry.Valid = true
+
+	return entry
+}
+
+// indexWav decodes a wav file for the index.
+func indexWav(fileName string, opts decodeOptions) (*Sequence, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeSequence(context.Background(), f, opts)
+}
+
+// indexJSON loads a JSON file for the index, checking it encodes and, if it
+// records checksums, that they're the ones encoding it gives. Files written
+// by hand usually have no checksums, which is fine since encoding fills them
+// in.
+func indexJSON(fileName string, opts decodeOptions) (*Sequence, error) {
+	sequence, err := opts.loadSequence(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := opts.encodeSequence(sequence, 0)
+	if err != nil {
+		return sequence, err
+	}
+
+	encoded, err := opts.parseBytes(data)
+	if err != nil {
+		return sequence, err
+	}
+
+	if sequence.Channel1ChecksumByte != 0 && sequence.Channel1ChecksumByte != encoded.Channel1ChecksumByte {
+		return sequence, &ChecksumError{Channel: 1, Stored: int8(sequence.Channel1ChecksumByte), Computed: int8(encoded.Channel1ChecksumByte), ProgramNumber: sequence.ProgramNumber}
+	}
+
+	if sequence.Channel2ChecksumByte != 0 && sequence.Channel2ChecksumByte != encoded.Channel2ChecksumByte {
+		return sequence, &ChecksumError{Channel: 2, Stored: int8(sequence.Channel2ChecksumByte), Computed: int8(encoded.Channel2ChecksumByte), ProgramNumber: sequence.ProgramNumber}
+	}
+
+	return sequence, nil
+}
+
+// summarizeNotes fills in the entry's program number, channels and note
+// summary from the sequence.
+func summarizeNotes(entry *indexEntry, sequence *Sequence) {
+	entry.ProgramNumber = sequence.ProgramNumber
+	entry.Channels = 1
+	if len(sequence.Channel2Notes) > 0 {
+		entry.Channels = 2
+	}
+
+	ch1Notes, ch1Bars, ch2Notes, ch2Bars := sequence.Counts()
+	entry.Channel1Notes = ch1Notes
+	entry.Channel2Notes = ch2Notes
+	entry.Bars = ch1Bars + ch2Bars
+	entry.Fingerprint = sequence.Fingerprint()
+
+	histogram := make([]int, len(noteNames))
+
+	for _, notes := range [][]NoteLine{sequence.Channel1Notes, sequence.Channel2Notes} {
+		for _, note := range notes {
+			if note.Bar || note.NoteNum < MinNote || note.NoteNum > MaxNote {
+				continue
+			}
+
+			histogram[note.NoteNum%12]++
+		}
+	}
+
+	low, high, ok := sequence.PitchRange()
+	if !ok {
+		return
+	}
+
+	top := 0
+	for i, count := range histogram {
+		if count > histogram[top] {
+			top = i
+		}
+	}
+
+	entry.LowestNote = low.String()
+	entry.HighestNote = high.String()
+	entry.TopNote = noteNames[top]
+}
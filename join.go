@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-audio/wav"
+)
+
+// leaderSeconds is the length of the leader tone before each sequence, and
+// trailerSeconds the length of the tone after it.
+const (
+	leaderSeconds  = 7
+	trailerSeconds = 1
+)
+
+// joinFiles encodes each JSON sequence file in turn to one wav file, so that
+// several programs can be saved to one side of a tape. Every sequence keeps
+// its own leader and trailing tones, which is what the MC-202 and DecodeAll
+// look for between them. It prints where each sequence's data starts.
+//
+// The audio is written as it's generated, so memory use doesn't grow with the
+// number of sequences. Every file is loaded and encoded before any audio is
+// written, so a bad file doesn't leave a partial wav file behind.
+func joinFiles(fileNames []string, outName string, channels int, opts encodeOptions) error {
+	var (
+		sequences []*Sequence
+		encoded   [][]byte
+	)
+
+	for _, fileName := range fileNames {
+		sequence, err := opts.loadSequence(fileName)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+
+		data, err := opts.encodeSequence(sequence, channels)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+
+		if opts.verify {
+			if _, err := verifyEncoding(data, opts, nil); err != nil {
+				return fmt.Errorf("%s: %w", fileName, err)
+			}
+		}
+
+		sequences = append(sequences, sequence)
+		encoded = append(encoded, data)
+	}
+
+	label := strings.TrimSuffix(filepath.Base(outName), filepath.Ext(outName))
+
+	metadata := &wav.Metadata{
+		Title:    infoString(label),
+		Software: infoString("mc-202-librarian"),
+	}
+
+	return writeWavStream(outName, metadata, func(write func([]int) error) error {
+		var written int
+
+		count := func(samples []int) error {
+			written += len(samples)
+			return write(samples)
+		}
+
+		for i, data := range encoded {
+			start := float64(written)/sampleRate + leaderSeconds
+
+			if err := streamSequenceSamples(data, opts, count); err != nil {
+				return err
+			}
+
+			logf("%s: program %03d at %.2fs\n", fileNames[i], sequences[i].ProgramNumber, start)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+)
+
+// The JSON field name styles -json-style can choose between. Sequences used
+// to be written with the Go field names, such as Channel1LineCount, which are
+// awkward to use from other languages, so they're now written in snake_case,
+// such as channel_1_line_count. Files with either are read.
+const (
+	jsonStyleSnake = "snake"
+	jsonStyleGo    = "go"
+)
+
+// jsonFieldNames maps the snake_case JSON name of every Sequence and NoteLine
+// field, including the Header's, to its Go field name. Raw is left out since
+// it has always been written as raw.
+var jsonFieldNames = buildJSONFieldNames(reflect.TypeOf(Sequence{}), reflect.TypeOf(NoteLine{}))
+
+func buildJSONFieldNames(types ...reflect.Type) map[string]string {
+	names := make(map[string]string)
+
+	for _, t := range types {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+
+			// an embedded struct's fields are written as the outer struct's
+			if field.Anonymous {
+				for name, goName := range buildJSONFieldNames(field.Type) {
+					names[name] = goName
+				}
+				continue
+			}
+
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" || field.Name == "Raw" {
+				continue
+			}
+
+			names[name] = field.Name
+		}
+	}
+
+	return names
+}
+
+// goFieldNames rewrites the snake_case keys in JSON written from a Sequence to
+// the Go field names, keeping the order and indentation. Keys are only
+// matched quoted and followed by a colon, which no value can contain.
+func goFieldNames(data []byte) []byte {
+	for name, goName := range jsonFieldNames {
+		data = bytes.ReplaceAll(data, []byte(`"`+name+`":`), []byte(`"`+goName+`":`))
+	}
+
+	return data
+}
+
+// snakeFieldNames rewrites the keys of JSON decoded into v that are Go field
+// names to their snake_case names, in place, and returns v. Go field names
+// are matched regardless of case, the way encoding/json matched them before
+// the fields had tags.
+func snakeFieldNames(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			snakeFieldNames(value)
+
+			for name, goName := range jsonFieldNames {
+				if strings.EqualFold(key, goName) {
+					delete(v, key)
+					v[name] = value
+					break
+				}
+			}
+		}
+	case []any:
+		for _, value := range v {
+			snakeFieldNames(value)
+		}
+	}
+
+	return v
+}
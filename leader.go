@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-audio/wav"
+)
+
+// The defaults for how far into a file the leader tone is looked for, and how
+// far its frequency can be from oneFreq, as a fraction of it. Recordings often
+// start with a few seconds of silence or hiss before the leader.
+const (
+	defaultLeaderWindow    = 10 * time.Second
+	defaultLeaderTolerance = 0.1
+)
+
+// The leader tone is looked for in blocks of leaderBlock, and has to be heard
+// in enough of them in a row to last minLeader. minLeader is shorter than the
+// data buffer, which is all one tone too, so a file decoded from just before
+// the data still passes.
+const (
+	leaderBlock = 10 * time.Millisecond
+	minLeader   = 150 * time.Millisecond
+)
+
+// checkLeader reads the first opts.leaderWindow of the file, from where
+// decoding starts, and returns ErrNoLeaderTone if no channel of it that's
+// decoded holds a leader tone. Without one the file is very unlikely to be an
+// MC-202 recording, and decoding it would scan the whole file before failing
+// with an error that doesn't say why. A window of zero skips the check.
+//
+// The leader almost always starts within the first second, so the window is
+// read a second at first, and doubled until it's read in full, rather than
+// reading it all for every file.
+func checkLeader(ctx context.Context, decoder *wav.Decoder, opts decodeOptions) error {
+	if opts.leaderWindow <= 0 {
+		return nil
+	}
+
+	// either of the channels the decode strategies read will do
+	channels := min(int(decoder.NumChans), 2)
+
+	window := opts
+	window.leaderWindow = min(time.Second, opts.leaderWindow)
+
+	for {
+		ended := false
+
+		for channel := 0; channel < channels; channel++ {
+			samples, err := readLeaderWindow(ctx, decoder, window, channel)
+			if err != nil {
+				return &signChangeError{err: err}
+			}
+
+			ended = len(samples) < int(window.leaderWindow.Seconds()*float64(decoder.SampleRate))
+
+			err = checkLeaderSamples(samples, int(decoder.SampleRate), window)
+			opts.buffers.putSamples(samples)
+
+			if err == nil {
+				return nil
+			}
+		}
+
+		if ended || window.leaderWindow == opts.leaderWindow {
+			return noLeaderError(opts.leaderWindow)
+		}
+
+		window.leaderWindow = min(2*window.leaderWindow, opts.leaderWindow)
+	}
+}
+
+// readLeaderWindow reads the samples of the first opts.leaderWindow of a
+// channel of the file from where decoding starts.
+func readLeaderWindow(ctx context.Context, decoder *wav.Decoder, opts decodeOptions, channel int) ([]float64, error) {
+	start, end := opts.frameRange(decoder)
+
+	windowEnd := start + int(opts.leaderWindow.Seconds()*float64(decoder.SampleRate))
+	if end > 0 {
+		windowEnd = min(windowEnd, end)
+	}
+
+	return readSamples(ctx, decoder, signChangeOptions{
+		startFrame:   start,
+		endFrame:     windowEnd,
+		hysteresis:   opts.hysteresis,
+		sampleFormat: opts.sampleFormat,
+		channel:      channel,
+		buffers:      opts.buffers,
+	})
+}
+
+// checkLeaderSamples is checkLeader for samples that have already been read,
+// from where decoding starts, at rate.
+func checkLeaderSamples(samples []float64, rate int, opts decodeOptions) error {
+	if opts.leaderWindow <= 0 {
+		return nil
+	}
+
+	samples = samples[:min(len(samples), int(opts.leaderWindow.Seconds()*float64(rate)))]
+
+	// a file too short to hold the leader is left to fail decoding, which
+	// says it's too short
+	if len(samples) < int(minLeader.Seconds()*float64(rate)) {
+		return nil
+	}
+
+	if hasLeaderTone(signChangeBits(samples, opts.hysteresis, false), rate, opts.leaderTolerance) {
+		return nil
+	}
+
+	return noLeaderError(opts.leaderWindow)
+}
+
+// noLeaderError returns the error for a file with no leader tone in the
+// window it was looked for in.
+func noLeaderError(window time.Duration) error {
+	return fmt.Errorf("%w: no %d Hz leader tone in the first %v, use -leader-window to look further in or 0 to decode it anyway", ErrNoLeaderTone, oneFreq, window)
+}
+
+// hasLeaderTone reports whether the sign change bits hold oneFreq, to within
+// tolerance, for at least minLeader without a break. The sign changes are
+// counted a block at a time rather than timed one by one, so the tone is
+// still found at low sample rates, where a half cycle is only a frame or two
+// and rounds a long way off, and through the odd spurious sign change.
+func hasLeaderTone(signBits []int, rate int, tolerance float64) bool {
+	blockFrames := int(leaderBlock.Seconds() * float64(rate))
+	if blockFrames == 0 {
+		return false
+	}
+
+	expected := 2 * oneFreq * float64(blockFrames) / float64(rate)
+	needed := int(math.Ceil(float64(minLeader) / float64(leaderBlock)))
+
+	run := 0
+
+	for start := 0; start+blockFrames <= len(signBits); start += blockFrames {
+		changes := sum(signBits[start : start+blockFrames])
+
+		if math.Abs(float64(changes)-expected) > expected*tolerance {
+			run = 0
+			continue
+		}
+
+		run++
+		if run >= needed {
+			return true
+		}
+	}
+
+	return false
+}
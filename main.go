@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-audio/audio"
 	"github.com/go-audio/wav"
@@ -26,15 +33,179 @@ const (
 	// rest of the data
 	dataBufferLength = 122
 	barByte          = 0xFF
+	// the fewest bits a save can take up: ten bytes, which is an empty
+	// sequence, and the data buffer, less the last byte's stop bits
+	minSequenceBits = 10*11 + dataBufferLength - 2
+	// how many iterations of the byte assembly loop run between checks for
+	// cancellation
+	ctxCheckInterval = 1 << 14
 )
 
+// quiet is set by -quiet to leave only the output that was asked for, so the
+// tool can be used in scripts. Errors and warnings go to stderr regardless.
+var quiet bool
+
+// logln prints a progress message with fmt.Println unless quiet is set.
+func logln(a ...any) {
+	if !quiet {
+		fmt.Println(a...)
+	}
+}
+
+// logf prints a progress message with fmt.Printf unless quiet is set.
+func logf(format string, a ...any) {
+	if !quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// MinNote and MaxNote are the lowest and highest note numbers the MC-202 can
+// store. The note byte has six bits for the note number, so 61-63 fit in the
+// byte but aren't valid notes.
+const (
+	MinNote = 0
+	MaxNote = 60
+)
+
+// Step and gate lengths are stored as a single byte each, in MC-202 clock
+// units. The manual gives no limits for them beyond what can be keyed in, so
+// these aren't hardware limits, they're the range of a line on tape. A line of
+// barByte is a bar, and the validator counts a gate of barByte as one too, so
+// neither length can be barByte; every other byte can be stored and is
+// accepted. The validator needs no check of its own: every line it reads as a
+// step or gate is within these limits by construction.
+const (
+	MinStepLength = 0
+	MaxStepLength = barByte - 1
+	MinGateLength = 0
+	MaxGateLength = barByte - 1
+)
+
+// DefaultMaxLineCount is the most lines validateBytes accepts in a line count
+// unless -max-lines changes it.
+//
+// Memory capacity: Approx. 2600 steps (pg. 61 of MC-202 manual)
+// A step is 3 lines, therefore, the maximum number of lines is 2600*3, around
+// 7800. Not sure what the absolute maximum is here, but in my testing, I
+// was able to get up to 8200, so this leaves some headroom over that.
+const DefaultMaxLineCount = 10000
+
+// sequenceOptions controls how the bytes of a save and JSON sequence files are
+// checked, read and written, whether they're being decoded or encoded.
+type sequenceOptions struct {
+	// maxLineCount is the most lines a line count can be. It's a guard
+	// against line counts read from noise rather than a hardware limit, so
+	// it can be raised for dumps from modified units or of concatenated data.
+	maxLineCount int
+	// lenientParse clamps note names in JSON files that are out of range or
+	// don't match their note number, instead of rejecting the file.
+	lenientParse bool
+	// gateCheck is what checkGateLengths does with a note whose gate is
+	// longer than its step.
+	gateCheck string
+	// jsonStyle is the style JSON files are written in.
+	jsonStyle string
+}
+
+var defaultSequenceOptions = sequenceOptions{
+	maxLineCount: DefaultMaxLineCount,
+	gateCheck:    gateCheckOff,
+	jsonStyle:    jsonStyleSnake,
+}
+
+// ClockPPQN is the resolution of the MC-202's clock in pulses per quarter
+// note. Step and gate lengths are counted in these pulses, so a step of 6 is a
+// sixteenth note and a step of 24 is a quarter note.
+const ClockPPQN = 24
+
+// The parts of a note byte: the top bit is portamento, the next accent, and
+// the six below them the note number.
+const (
+	portamentoMask = 0b10000000
+	accentMask     = 0b01000000
+	noteNumMask    = 0b00111111
+)
+
+var noteNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// flatNoteNames are noteNames with the black keys spelled as flats.
+var flatNoteNames = []string{"C", "Db", "D", "Eb", "E", "F", "Gb", "G", "Ab", "A", "Bb", "B"}
+
 var noteMap = buildNoteMap()
 
+// ParseNote returns the note number of a note name and octave, as they're
+// written in the JSON: "C" and 1 is note 0, "C" and 6 is note 60. A name that
+// isn't a note returns ErrInvalidNoteName, a note the MC-202 can't play
+// returns ErrNoteOutOfRange along with the note number it would have been.
+func ParseNote(name string, octave int) (int, error) {
+	for i, noteName := range noteNames {
+		if !strings.EqualFold(name, noteName) {
+			continue
+		}
+
+		noteNum := (octave-1)*12 + i
+		if noteNum < MinNote || noteNum > MaxNote {
+			return noteNum, fmt.Errorf("%w: %s%d", ErrNoteOutOfRange, name, octave)
+		}
+
+		return noteNum, nil
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrInvalidNoteName, name)
+}
+
+// NewNoteLine returns a note line for a note written as its name and octave,
+// such as "C#4", lasting step with its gate held for gate at tempo beats per
+// minute. The lengths are rounded to the nearest clock pulse, so at 120 BPM,
+// where a pulse is about 20.8ms, a 125ms sixteenth note is a step of 6. It
+// returns the errors ParseNote does for the note, and ErrStepOutOfRange or
+// ErrGateOutOfRange for a length the MC-202 can't store once it's rounded.
+func NewNoteLine(note string, step, gate time.Duration, tempo float64, accent, portamento bool) (NoteLine, error) {
+	if tempo <= 0 {
+		return NoteLine{}, fmt.Errorf("invalid tempo: %g", tempo)
+	}
+
+	name := strings.TrimRight(note, "0123456789")
+
+	octave, err := strconv.Atoi(note[len(name):])
+	if err != nil {
+		return NoteLine{}, fmt.Errorf("%w: %q has no octave", ErrInvalidNoteName, note)
+	}
+
+	noteNum, err := ParseNote(name, octave)
+	if err != nil {
+		return NoteLine{}, err
+	}
+
+	millis := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	stepLength := MillisToStep(millis(step), ClockPPQN, tempo)
+	if stepLength < MinStepLength || stepLength > MaxStepLength {
+		return NoteLine{}, fmt.Errorf("%w: %v is %d clock pulses at %g BPM", ErrStepOutOfRange, step, stepLength, tempo)
+	}
+
+	gateLength := MillisToStep(millis(gate), ClockPPQN, tempo)
+	if gateLength < MinGateLength || gateLength > MaxGateLength {
+		return NoteLine{}, fmt.Errorf("%w: %v is %d clock pulses at %g BPM", ErrGateOutOfRange, gate, gateLength, tempo)
+	}
+
+	return NoteLine{
+		NoteNum:    noteNum,
+		NoteName:   noteMap[noteNum].NoteName,
+		Octave:     noteMap[noteNum].Octave,
+		StepLength: stepLength,
+		GateLength: gateLength,
+		Portamento: portamento,
+		Accent:     accent,
+	}, nil
+}
+
 func buildNoteMap() map[int]Note {
-	noteNames := []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
 	noteMap := make(map[int]Note)
 
-	for i := 0; i < 61; i++ {
+	for i := MinNote; i <= MaxNote; i++ {
 		noteMap[i] = Note{
 			NoteNum:  i,
 			NoteName: noteNames[i%12],
@@ -46,29 +217,403 @@ func buildNoteMap() map[int]Note {
 }
 
 // generateSignChangeBits reads a WAV file and emits a stream of sign-change bits.
-func generateSignChangeBits(decoder *wav.Decoder, offset bool) ([]int, error) {
-	var bits []int
+// Only the first channel is read. The sign changes don't depend on the level,
+// so a quiet file, such as one summed to mono from channels that partly
+// cancel out, gives the same bits as a loud one as long as the tone is clear
+// of the noise.
+func generateSignChangeBits(decoder *wav.Decoder) ([]int, error) {
+	return readSignChangeBits(context.Background(), decoder, signChangeOptions{})
+}
+
+// DecodeResult holds the bytes decoded from a WAV file along with the sign
+// change bits they were assembled from and the strategy that decoded them.
+type DecodeResult struct {
+	SignBits []int
+	Bytes    []byte
+	// Offsets is the frame of SignBits each byte's start bit begins at, as
+	// the bytes were assembled. It's nil if the bytes weren't assembled from
+	// one place in the recording, such as when takes were reconciled.
+	Offsets    []int
+	Strategy   string
+	SampleRate int
+	// FramesPerBit is the length of a bit period in frames that the bytes
+	// were assembled with.
+	FramesPerBit int
+	// StartFrame is the frame the sign change bits start from, which is
+	// non-zero when decoding started at a cue marker.
+	StartFrame int
+	// Levels is how loud the samples decoded were, or nil if the bytes were
+	// decoded from sign change bits rather than samples.
+	Levels *Levels
+	// PrimedUpFront is set when the first buffer looked out of step before
+	// decoding, so the primed strategy was tried first.
+	PrimedUpFront bool
+	// FalseMagicBytes is how many magic bytes were found and backtracked from
+	// before the one the save starts with.
+	FalseMagicBytes int
+}
+
+// generateWavBytes reads a WAV file and assembles the bytes it contains. Each
+// of the decode strategies is tried in turn until one assembles; if none do,
+// the error from the first is returned.
+//
+// Some files don't decode when read from the very first PCM buffer: either the
+// first read after the header errors, or the frames it returns are out of
+// step with the rest of the data chunk. It looks like a header/data chunk
+// alignment issue in files written by some recorders, though we haven't been
+// able to reproduce it with files this tool writes. Dropping the first buffer
+// gets past it, so the primed strategy does that rather than every caller.
+//
+// The primed strategy is tried first when the first buffer can be seen to be
+// out of step before decoding, which saves a whole failed decode.
+//
+// If the file has a cue marker, decoding starts there first and the other
+// strategies are only tried if that fails.
+func generateWavBytes(ctx context.Context, decoder *wav.Decoder, opts decodeOptions) (*DecodeResult, error) {
+	var firstErr error
+
+	if err := opts.checkRange(decoder); err != nil {
+		return nil, err
+	}
+
+	leaderStart := time.Now()
+
+	if err := checkLeader(ctx, decoder, opts); err != nil {
+		return nil, err
+	}
+
+	opts.profile.since(profileLeader, leaderStart)
+
+	strategies := decodeStrategies
+	primedUpFront := false
+
+	if start, ok := cueStart(decoder); ok && opts.startSec == 0 {
+		cue := decodeStrategy{name: cueStrategyName, opts: signChangeOptions{startFrame: start}}
+		strategies = append([]decodeStrategy{cue}, strategies...)
+	} else if opts.startSec == 0 && firstBufferOutOfStep(ctx, decoder, opts) {
+		primedUpFront = true
+
+		strategies = nil
+		for _, strategy := range decodeStrategies {
+			if strategy.name == primedStrategyName {
+				strategies = append([]decodeStrategy{strategy}, strategies...)
+			} else {
+				strategies = append(strategies, strategy)
+			}
+		}
+	}
+
+	for _, strategy := range strategies {
+		if !strategy.applies(decoder) {
+			continue
+		}
+
+		result, err := strategy.decode(ctx, decoder, opts)
+		if err == nil {
+			result.Strategy = strategy.name
+			result.SampleRate = int(decoder.SampleRate)
+			result.FramesPerBit = strategy.framesPerBit(int(decoder.SampleRate))
+			result.StartFrame = strategy.signChangeOptions(decoder, opts).startFrame
+			result.PrimedUpFront = primedUpFront && strategy.name == primedStrategyName
+
+			return result, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var readErr *signChangeError
+		if errors.As(err, &readErr) {
+			return nil, err
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// decodeOptions controls how a wav file is decoded, whichever strategy is
+// used.
+type decodeOptions struct {
+	// hysteresis is the fraction of full scale a sample has to pass on the
+	// other side of zero before it counts as a sign change. Zero counts every
+	// change.
+	hysteresis float64
+	// sampleFormat is the name of the sample format to read the data chunk
+	// as, overriding the header. Empty uses the header.
+	sampleFormat string
+	// startSec and endSec limit decoding to part of the file. An endSec of
+	// zero decodes to the end.
+	startSec float64
+	endSec   float64
+	// demod is the name of the demodulator to read bits with. Empty uses
+	// the sign change demodulator.
+	demod string
+	// partial writes the notes read from a recording that was cut off to a
+	// json file instead of only reporting it.
+	partial bool
+	// adaptiveClock re-estimates the bit period as the bytes are read, for
+	// tapes whose speed wanders within a sequence.
+	adaptiveClock bool
+	// leaderWindow is how far from where decoding starts to look for the
+	// leader tone before giving up on the file. Zero doesn't look.
+	leaderWindow time.Duration
+	// leaderTolerance is how far the leader tone's frequency can be from
+	// oneFreq, as a fraction of it.
+	leaderTolerance float64
+	// takes decodes every take in a recording to reconcile them, so a
+	// recording that doesn't decode as a whole is still read for them.
+	takes bool
+	// stopBitTolerance is how many stop bits in a sequence assembleBytes
+	// lets through when they're too weak to read as a one but aren't a
+	// zero, once the magic byte and program number have been read. Zero is
+	// strict.
+	stopBitTolerance int
+	// maxFalseMagic is how many false magic bytes assembleBytes backtracks
+	// from before giving up on the recording as noise. Negative is no limit.
+	maxFalseMagic int
+	// profile, if set, adds up how long each stage of the decode takes.
+	profile *decodeProfile
+	// buffers is the Decoder whose buffers the files are read with, so they
+	// can be reused from one decode to the next. Nil allocates new ones for
+	// every read.
+	buffers *Decoder
+
+	sequenceOptions
+}
+
+var defaultDecodeOptions = decodeOptions{
+	leaderWindow:    defaultLeaderWindow,
+	leaderTolerance: defaultLeaderTolerance,
+	maxFalseMagic:   -1,
+	sequenceOptions: defaultSequenceOptions,
+}
+
+// frameRange returns the frames decoding starts and ends at. An end of zero
+// is the end of the file.
+func (o decodeOptions) frameRange(decoder *wav.Decoder) (start, end int) {
+	rate := float64(decoder.SampleRate)
+
+	return int(o.startSec * rate), int(o.endSec * rate)
+}
+
+// checkRange checks that the time range to decode is inside the file.
+func (o decodeOptions) checkRange(decoder *wav.Decoder) error {
+	if o.startSec == 0 && o.endSec == 0 {
+		return nil
+	}
+
+	duration, err := decoder.Duration()
+	if err != nil {
+		return err
+	}
+
+	length := duration.Seconds()
+
+	if o.startSec < 0 || o.startSec >= length {
+		return fmt.Errorf("%w: start %.3fs is outside the file's %.3fs", ErrInvalidTimeRange, o.startSec, length)
+	}
+
+	if o.endSec != 0 && (o.endSec <= o.startSec || o.endSec > length) {
+		return fmt.Errorf("%w: end %.3fs must be after the start and within the file's %.3fs", ErrInvalidTimeRange, o.endSec, length)
+	}
+
+	return nil
+}
+
+// signChangeOptions controls how readSignChangeBits reads the PCM data.
+type signChangeOptions struct {
+	// prime drops the first buffer of PCM data before reading.
+	prime bool
+	// startFrame is the first frame a sign change bit is emitted for. The
+	// frames before it are read but skipped.
+	startFrame int
+	// endFrame is the frame reading stops at. Zero reads to the end.
+	endFrame int
+	// invert starts the sign change bits as though the sample before the
+	// first was negative rather than positive.
+	invert bool
+	// hysteresis is the fraction of full scale a sample has to pass before
+	// its sign is taken, so a signal hovering around zero doesn't register
+	// as a run of sign changes.
+	hysteresis float64
+	// sampleFormat is the name of the sample format to read the data chunk
+	// as, overriding the header. Empty uses the header.
+	sampleFormat string
+	// channel is the channel of a stereo file to read, counting from 0.
+	channel int
+	// buffers is the Decoder whose buffers the samples are read with. Nil
+	// allocates new ones.
+	buffers *Decoder
+}
+
+// readSignChangeBits reads the sign change bits from the start of the PCM data.
+func readSignChangeBits(ctx context.Context, decoder *wav.Decoder, opts signChangeOptions) ([]int, error) {
+	samples, err := readSamples(ctx, decoder, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return signChangeBits(samples, opts.hysteresis, opts.invert), nil
+}
+
+// signChangeBits returns a 1 for each sample whose sign differs from the one
+// before it and a 0 for each that doesn't. Samples within hysteresis of zero
+// are taken to have the same sign as the one before them. The sample before
+// the first is taken to be positive, or negative if invert is set.
+func signChangeBits(samples []float64, hysteresis float64, invert bool) []int {
+	bits := make([]int, len(samples))
+
+	previous := invert
+
+	for i, sample := range samples {
+		negative := math.Signbit(sample)
+		if hysteresis > 0 && math.Abs(sample) <= hysteresis {
+			negative = previous
+		}
+
+		if negative != previous {
+			bits[i] = 1
+		}
+		previous = negative
+	}
+
+	return bits
+}
+
+// Decoder decodes sequences from wav files, keeping the buffer it reads the
+// PCM data through and the slices of samples it has finished with for the
+// next decode to reuse. The samples are the largest allocation in a decode,
+// and each file is read once for every strategy tried, so a batch decode of a
+// directory gets through far fewer of them with one Decoder than with a new
+// one for every file. A Decoder isn't safe for concurrent use: give each
+// goroutine its own.
+type Decoder struct {
+	buf     *audio.IntBuffer
+	samples [][]float64
+}
+
+// NewDecoder returns a Decoder with no buffers yet; they're allocated by the
+// first decode.
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Decode decodes the sequence in a WAV file.
+func (d *Decoder) Decode(r io.ReadSeeker) (*Sequence, error) {
+	return d.DecodeContext(context.Background(), r)
+}
+
+// DecodeContext decodes the sequence in a WAV file, returning the context's
+// error as soon as it notices ctx is done.
+func (d *Decoder) DecodeContext(ctx context.Context, r io.ReadSeeker) (*Sequence, error) {
+	opts := defaultDecodeOptions
+	opts.buffers = d
 
-	var previous byte
+	return decodeSequence(ctx, r, opts)
+}
+
+// pcmBuffer returns the buffer to read PCM data through. A nil Decoder
+// returns a new one every time.
+func (d *Decoder) pcmBuffer() *audio.IntBuffer {
+	if d == nil || d.buf == nil {
+		buf := &audio.IntBuffer{Data: make([]int, framesToRead), Format: &audio.Format{}}
+		if d != nil {
+			d.buf = buf
+		}
+
+		return buf
+	}
+
+	return d.buf
+}
+
+// getSamples returns an empty slice to read samples into, reusing one that
+// putSamples was given if there is one.
+func (d *Decoder) getSamples() []float64 {
+	if d == nil || len(d.samples) == 0 {
+		return nil
+	}
+
+	samples := d.samples[len(d.samples)-1]
+	d.samples = d.samples[:len(d.samples)-1]
+
+	return samples[:0]
+}
+
+// putSamples gives samples back to be reused once nothing refers to them. A
+// nil Decoder leaves them to the garbage collector.
+func (d *Decoder) putSamples(samples []float64) {
+	if d != nil && cap(samples) > 0 {
+		d.samples = append(d.samples, samples)
+	}
+}
+
+// readSamples reads one channel of the PCM data, the first unless opts says
+// otherwise, scaled to between -1 and 1. If prime is set, the first buffer is
+// read and thrown away first. If the first read returns an error the decoder
+// is rewound and primed regardless.
+func readSamples(ctx context.Context, decoder *wav.Decoder, opts signChangeOptions) ([]float64, error) {
+	samples := opts.buffers.getSamples()
+
+	prime := opts.prime
+	frame := 0
+
+	// the decoder reads the header again every time it's rewound, so the
+	// sample format has to be forced again after each rewind
+	rewind := func() {
+		decoder.Rewind()
+
+		if format, ok := sampleFormats[opts.sampleFormat]; ok {
+			decoder.BitDepth = uint16(format.bitDepth)
+		}
+	}
+
+	rewind()
+
+	format := headerSampleFormat(decoder)
+	if override, ok := sampleFormats[opts.sampleFormat]; ok {
+		format = override
+	}
+
+	switch format.bitDepth {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("unsupported bit depth: %d", format.bitDepth)
+	}
 
 	numChannels := decoder.NumChans
-	bitDepth := decoder.BitDepth
+	if opts.channel >= int(numChannels) {
+		return nil, fmt.Errorf("no channel %d in a file with %d", opts.channel+1, numChannels)
+	}
 
-	decoder.Rewind()
+	fullScale := float64(int(1) << (format.bitDepth - 1))
 
-	buf := &audio.IntBuffer{Data: make([]int, framesToRead), Format: &audio.Format{}}
+	buf := opts.buffers.pcmBuffer()
 
-	// This is sometimes necessary as the first attempt at reading the file
-	// will result in an error, but if we read rewind, then read read the first frame
-	// before processing the rest of the file, it works. ??
-	if offset {
-		_, err := decoder.PCMBuffer(buf)
-		if err != nil {
-			return nil, fmt.Errorf("error reading offset buffer: %w", err)
+	if !prime {
+		if _, err := decoder.PCMBuffer(buf); err != nil {
+			prime = true
+		}
+
+		rewind()
+	}
+
+	if prime {
+		if _, err := decoder.PCMBuffer(buf); err != nil {
+			return nil, fmt.Errorf("error reading first buffer: %w", err)
 		}
 	}
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		n, err := decoder.PCMBuffer(buf)
 		if err != nil {
 			return nil, err
@@ -78,50 +623,78 @@ func generateSignChangeBits(decoder *wav.Decoder, offset bool) ([]int, error) {
 			break
 		}
 
-		for i := 0; i < len(buf.Data); i += int(numChannels) {
-			var msb byte
+		// a data chunk that ends part way through a frame leaves the rest
+		// of the frame as whatever was in the buffer, so it's dropped
+		n -= n % int(numChannels)
+
+		for i := 0; i < n; i += int(numChannels) {
+			if opts.endFrame > 0 && frame >= opts.endFrame {
+				return samples, nil
+			}
+
+			frame++
 
-			switch bitDepth {
-			case 16:
-				msb = byte(buf.Data[i] >> 8)
-			case 24:
-				msb = byte(buf.Data[i] >> 16)
-			case 32:
-				msb = byte(buf.Data[i] >> 24)
-			default:
-				return nil, fmt.Errorf("unsupported bit depth: %d", bitDepth)
+			if frame <= opts.startFrame {
+				continue
 			}
 
-			signBit := msb & 0x80
-			if signBit^previous != 0 {
-				bits = append(bits, 1)
+			sample := buf.Data[i+opts.channel]
+
+			if format.float {
+				samples = append(samples, float64(math.Float32frombits(uint32(sample))))
 			} else {
-				bits = append(bits, 0)
+				samples = append(samples, float64(sample)/fullScale)
 			}
-			previous = signBit
 		}
 	}
 
-	return bits, nil
+	return samples, nil
 }
 
 const BaseFreq = 2370 // Set your BASE_FREQ
 var BitMasks = []uint16{0x1, 0x2, 0x4, 0x8, 0x10, 0x20, 0x40, 0x80}
 
-// generateBytes processes the sign change bits and assembles them into bytes.
-func generateBytes(bitstream []int, framerate int) ([]byte, error) {
-	framesPerBit := int(float64(framerate)*4/BaseFreq + 0.5)
-	sample := make([]int, framesPerBit) // Slice to use as a circular buffer
-	var sampleIndex int                 // Current index in the sample buffer
+// generateBytes assembles the bits the demodulator finds into bytes.
+func generateBytes(demod Demodulator) ([]byte, error) {
+	result, _, err := assembleBytes(context.Background(), demod, 0)
+	return result, err
+}
+
+// framesPerBitForRate returns the number of frames a single bit occupies at
+// the given sample rate.
+func framesPerBitForRate(framerate int) int {
+	return int(float64(framerate)*4/BaseFreq + 0.5)
+}
+
+// assembleBytes assembles the demodulated bits into bytes, starting from frame
+// from. Alongside the bytes it returns the frame where each byte's start bit
+// begins. It gives up with the context's error once ctx is done.
+func assembleBytes(ctx context.Context, demod Demodulator, from int) ([]byte, []int, error) {
+	result, offsets, _, err := assembleBytesStats(ctx, demod, from, defaultDecodeOptions)
+	return result, offsets, err
+}
 
-	// Fill the initial buffer with data
-	for i := 0; i < framesPerBit-1; i++ {
-		sample[i] = bitstream[i]
+// assembleBytesStats is assembleBytes with the stop bit tolerance and false
+// magic byte limit of opts, also returning how many false magic bytes it
+// backtracked from: magic bytes that turned out not to start a save when a
+// program digit or stop bit after them was wrong. A clean recording has few
+// or none, noise has many. Once there are more than opts.maxFalseMagic it
+// gives up with ErrTooManyFalseMagic.
+func assembleBytesStats(ctx context.Context, demod Demodulator, from int, opts decodeOptions) ([]byte, []int, int, error) {
+	framesPerBit := demod.FramesPerBit()
+	length := demod.Len()
+
+	if length-from < minSequenceBits*framesPerBit {
+		return nil, nil, 0, fmt.Errorf("%w: %d frames", ErrTooShort, length-from)
 	}
 
-	var result []byte
-	signChanges := sum(sample) // Calculate initial sum of sign changes
-	bitstreamIndex := framesPerBit - 1
+	var (
+		result  []byte
+		offsets []int
+	)
+
+	// bitstreamIndex is the last frame of the bit period being looked at
+	bitstreamIndex := from + framesPerBit - 1
 
 	var (
 		foundMagicByte         bool
@@ -132,51 +705,80 @@ func generateBytes(bitstream []int, framerate int) ([]byte, error) {
 		channel1LineCount      int
 		channel2LineCountIndex int = -1
 		insideBuffer           bool
+		marginalStopBits       int
+		falseMagicBytes        int
 	)
 
+	var iterations int
+
+	// a demodulator that follows the speed of the tape is told about each run
+	// of one bits, after which the bit period may have changed
+	tracker, _ := demod.(clockTracker)
+	track := func(i, n int) {
+		if tracker != nil {
+			tracker.track(i, n)
+			framesPerBit = demod.FramesPerBit()
+		}
+	}
+
+	// falseMagic counts a magic byte that turned out not to start a save,
+	// and returns an error once there have been more than maxFalseMagic
+	falseMagic := func() error {
+		falseMagicBytes++
+		if opts.maxFalseMagic >= 0 && falseMagicBytes > opts.maxFalseMagic {
+			return fmt.Errorf("something went wrong: %w: more than %d", ErrTooManyFalseMagic, opts.maxFalseMagic)
+		}
+
+		return nil
+	}
+
 L1:
-	for bitstreamIndex < len(bitstream) {
+	for bitstreamIndex < length {
+		// checking the context on every frame is measurably slower, so only
+		// check every so often
+		iterations++
+		if iterations%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, falseMagicBytes, err
+			}
+		}
+
 		if insideBuffer {
 			for i := 0; i < dataBufferLength; i++ {
-				if sum(bitstream[bitstreamIndex:bitstreamIndex+framesPerBit]) < 7 {
-					return nil, fmt.Errorf("something went wrong: invalid data buffer")
+				if bitstreamIndex+framesPerBit > length {
+					return nil, nil, falseMagicBytes, fmt.Errorf("something went wrong: stream ended inside the data buffer: %w", ErrInvalidDataBuffer)
 				}
-				bitstreamIndex += framesPerBit
-			}
 
-			insideBuffer = false
+				if !demod.One(bitstreamIndex) {
+					return nil, nil, falseMagicBytes, fmt.Errorf("something went wrong: %w", ErrInvalidDataBuffer)
+				}
 
-			// Refill the sample buffer
-			for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
-				sample[sampleIndex] = bitstream[bitstreamIndex+i]
-				sampleIndex = (sampleIndex + 1) % framesPerBit
+				track(bitstreamIndex, 1)
+				bitstreamIndex += framesPerBit
 			}
 
-			signChanges = sum(sample)
+			insideBuffer = false
 
 			bitstreamIndex += framesPerBit
-		}
-
-		val := bitstream[bitstreamIndex]
 
-		if val > 0 {
-			signChanges++
-		}
-		if sample[sampleIndex] > 0 {
-			signChanges--
+			if bitstreamIndex >= length {
+				break
+			}
 		}
 
-		// Update the circular buffer
-		sample[sampleIndex] = val
-		sampleIndex = (sampleIndex + 1) % framesPerBit
-
-		if signChanges <= 4 {
+		if demod.Zero(bitstreamIndex - framesPerBit + 1) {
 			var (
-				byteVal uint16
+				byteVal   uint16
+				byteStart = bitstreamIndex - framesPerBit + 1
 			)
 
+			// not enough of the stream left for a whole byte
+			if bitstreamIndex+len(BitMasks)*framesPerBit > length {
+				break
+			}
+
 			for _, mask := range BitMasks {
-				if sum(bitstream[bitstreamIndex:bitstreamIndex+framesPerBit]) >= 7 {
+				if demod.One(bitstreamIndex) {
 					byteVal |= mask
 				}
 				bitstreamIndex += framesPerBit
@@ -195,20 +797,17 @@ L1:
 			// after the initial incorrect magic byte was found and continue iterating
 			if foundMagicByte && (validByteIndex+1 == 1 || validByteIndex+1 == 2 || validByteIndex+1 == 3) {
 				if int(byteVal) < 0 || int(byteVal) > 9 {
+					if err := falseMagic(); err != nil {
+						return nil, nil, falseMagicBytes, err
+					}
+
 					// return to the frame after the initial incorrect byte and continue
 					foundMagicByte = false
 					bitstreamIndex = magicByteIndex + framesPerBit
 					validByteIndex = -1
 					magicByteIndex = 0
 					result = result[:0]
-
-					// Refill the sample buffer
-					for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
-						sample[sampleIndex] = bitstream[bitstreamIndex+i]
-						sampleIndex = (sampleIndex + 1) % framesPerBit
-					}
-
-					signChanges = sum(sample)
+					offsets = offsets[:0]
 
 					bitstreamIndex += framesPerBit
 
@@ -225,7 +824,21 @@ L1:
 			// validByteIndex yet
 			if lastByteIndex == 0 || validByteIndex+1 != lastByteIndex {
 				for i := 0; i < 2; i++ {
-					if sum(bitstream[bitstreamIndex:bitstreamIndex+framesPerBit]) < 7 {
+					if bitstreamIndex+framesPerBit > length {
+						break L1
+					}
+
+					// once the magic byte and program number have been read,
+					// a stop bit too weak to read as a one, but that isn't a
+					// zero either, is let through up to stopBitTolerance times
+					if !demod.One(bitstreamIndex) && foundMagicByte && validByteIndex+1 > 3 &&
+						marginalStopBits < opts.stopBitTolerance && !demod.Zero(bitstreamIndex) {
+						marginalStopBits++
+						bitstreamIndex += framesPerBit
+						continue
+					}
+
+					if !demod.One(bitstreamIndex) {
 						// return to the frame after the initial incorrect byte and continue
 						bitstreamIndex = bitstreamIndex - framesPerBit*(8+i)
 
@@ -236,27 +849,34 @@ L1:
 						// the initial incorrect magic byte was found and continue iterating
 						// through the bitstream
 						if foundMagicByte {
+							if err := falseMagic(); err != nil {
+								return nil, nil, falseMagicBytes, err
+							}
+
 							foundMagicByte = false
 							bitstreamIndex = magicByteIndex + framesPerBit
 							validByteIndex = -1
 							magicByteIndex = 0
+							marginalStopBits = 0
 							result = result[:0]
+							offsets = offsets[:0]
 						}
 
-						// Refill the sample buffer
-						for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
-							sample[sampleIndex] = bitstream[bitstreamIndex+i]
-							sampleIndex = (sampleIndex + 1) % framesPerBit
-						}
-
-						signChanges = sum(sample)
-
 						bitstreamIndex += framesPerBit
 
 						continue L1
 					}
 					bitstreamIndex += framesPerBit
 				}
+
+				if tracker != nil && (foundMagicByte || byteVal == magicByte) {
+					track(bitstreamIndex-2*framesPerBit, 2)
+
+					// the tape may have sped up since this byte's start
+					// bit, and the next one is only looked for from where
+					// it's expected on, so start looking a little early
+					bitstreamIndex -= framesPerBit / 4
+				}
 			}
 
 			// VALID BYTE
@@ -268,20 +888,23 @@ L1:
 			}
 
 			if validByteIndex == 5 {
-				channel1LineCount = int(binary.BigEndian.Uint16([]byte{previousByte, byte(byteVal)}))
+				channel1LineCount = lineCountAt([]byte{previousByte, byte(byteVal)}, 0)
 
 				channel2LineCountIndex = validByteIndex + channel1LineCount + 3 // checksum byte, line count byte 1, line count byte 2
 			}
 
 			if validByteIndex == channel2LineCountIndex {
-				lastByteIndex = validByteIndex + int(binary.BigEndian.Uint16([]byte{previousByte, byte(byteVal)})) - channel1LineCount + 1
+				lastByteIndex = validByteIndex + lineCountAt([]byte{previousByte, byte(byteVal)}, 0) - channel1LineCount + 1
 			}
 
 			result = append(result, byte(byteVal))
+			offsets = append(offsets, byteStart)
 
 			previousByte = byte(byteVal)
 
-			// check for last byte
+			// check for last byte. decoding stops as soon as it has been read, so
+			// the trailing tone is never looked at and a noisy or missing one
+			// doesn't matter
 			if lastByteIndex != 0 && validByteIndex == lastByteIndex {
 				break
 			}
@@ -291,101 +914,411 @@ L1:
 				continue
 			}
 
-			// Refill the sample buffer
-			for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
-				sample[sampleIndex] = bitstream[bitstreamIndex+i]
-				sampleIndex = (sampleIndex + 1) % framesPerBit
-			}
-
-			signChanges = sum(sample)
-
 			bitstreamIndex += framesPerBit
 		} else {
 			bitstreamIndex++
 		}
 	}
 
+	// every way out of the loop other than reading the last byte is the
+	// stream running out, so if the line count was read, the recording was
+	// cut off rather than corrupt
+	if foundMagicByte && len(result) >= 6 && len(result) != lastByteIndex+1 {
+		expected := 0
+		if lastByteIndex != 0 {
+			expected = lastByteIndex + 1
+		}
+
+		return nil, nil, falseMagicBytes, &TruncatedError{Bytes: result, Expected: expected}
+	}
+
 	if len(result) != lastByteIndex+1 {
-		return nil, fmt.Errorf("something went wrong: invalid number of bytes: %d", len(result))
+		return nil, nil, falseMagicBytes, fmt.Errorf("something went wrong: %w: %d", ErrInvalidByteCount, len(result))
 	}
 
-	return result, nil
+	return result, offsets, falseMagicBytes, nil
 }
 
-// sum returns the sum of the elements in the slice.
-func sum(slice []int) int {
-	total := 0
-	for _, v := range slice {
-		total += v
+// BitWindow returns the slice of sign change bits the decoder read for the
+// decoded byte at byteIndex: the start bit, the eight data bits and the two
+// stop bits. It returns nil if the bitstream does not decode or byteIndex is
+// out of range.
+func BitWindow(bits []int, byteIndex, framesPerBit int) []int {
+	_, offsets, err := assembleBytes(context.Background(), newSignChangeDemodulator(bits, framesPerBit), 0)
+	if err != nil || byteIndex < 0 || byteIndex >= len(offsets) {
+		return nil
 	}
-	return total
-}
 
-type Sequence struct {
-	MagicByte                 byte
-	ProgramNumber             int
-	NumChannels               int
-	Channel1LineCount         int
-	Channel1Notes             []NoteLine
-	Channel1Checksum          byte
-	Channel1ChecksumByte      byte
-	Channel2Notes             []NoteLine
-	Channel2LineCount         int
-	Channel2AdjustedLineCount int
-	Channel2Checksum          byte
-	Channel2ChecksumByte      byte
-}
+	start := offsets[byteIndex]
+	end := start + 11*framesPerBit
 
-type NoteLine struct {
-	NoteNum    int
-	NoteName   string
-	Octave     int
-	StepLength int
-	GateLength int
-	Portamento bool
-	Accent     bool
-	Bar        bool
-}
+	if end > len(bits) {
+		end = len(bits)
+	}
 
-type Note struct {
-	NoteNum  int
-	NoteName string
-	Octave   int
+	return bits[start:end]
 }
 
-func validateBytes(data []byte) error {
-	if len(data) < 10 {
-		return fmt.Errorf("validation failed - invalid number of bytes: %d", len(data))
-	}
+// Timestamps returns the time in seconds, from the start of the recording, at
+// which each byte's start bit begins, from the offsets it was assembled at.
+func (r *DecodeResult) Timestamps() []float64 {
+	timestamps := make([]float64, len(r.Offsets))
 
-	if data[0] != magicByte {
-		return fmt.Errorf("validation failed - invalid magic byte: %02X", data[0])
+	for i, offset := range r.Offsets {
+		timestamps[i] = float64(r.StartFrame+offset) / float64(r.SampleRate)
 	}
 
-	if int(data[1]) < 0 || int(data[1]) > 9 {
-		return fmt.Errorf("validation failed - invalid program number byte 1: %d", int(data[1]))
-	}
+	return timestamps
+}
 
-	if int(data[2]) < 0 || int(data[2]) > 9 {
-		return fmt.Errorf("validation failed - invalid program number byte 2: %d", int(data[2]))
+// ByteTimestamps returns the time in seconds, from the start of the recording,
+// at which each decoded byte's start bit begins. It returns nil if the
+// bitstream does not decode.
+func ByteTimestamps(bits []int, framesPerBit, rate int) []float64 {
+	_, offsets, err := assembleBytes(context.Background(), newSignChangeDemodulator(bits, framesPerBit), 0)
+	if err != nil {
+		return nil
 	}
 
-	if int(data[3]) < 0 || int(data[3]) > 9 {
-		return fmt.Errorf("validation failed - invalid program number byte 3: %d", int(data[3]))
+	timestamps := make([]float64, len(offsets))
+
+	for i, offset := range offsets {
+		timestamps[i] = float64(offset) / float64(rate)
 	}
 
-	channel1LineCount := int(binary.BigEndian.Uint16(data[4:6]))
+	return timestamps
+}
 
-	// Memory capacity: Approx. 2600 steps (pg. 61 of MC-202 manual)
-	// A step is 3 lines, therefore, the maximum number of lines is 2600*3
-	// Not sure what the absolute maximum is here, but in my testing, I
-	// was able to get up to 8200.
-	if channel1LineCount < 0 || channel1LineCount > 10000 {
-		return fmt.Errorf("validation failed - invalid channel 1 line count: %d", channel1LineCount)
+// writeBits writes the sign change bits to a file, one bit per line.
+func writeBits(fileName string, bits []int) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	for _, bit := range bits {
+		if _, err := fmt.Fprintln(w, bit); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// checkWavFile checks that the decoder is reading a wav file that has some
+// audio in it.
+func checkWavFile(decoder *wav.Decoder) error {
+	if decoder.IsValidFile() {
+		return nil
+	}
+
+	// the headers were fine, so it's the data chunk that's empty
+	if decoder.Err() == nil && decoder.NumChans > 0 && decoder.BitDepth >= 8 {
+		return ErrTooShort
+	}
+
+	return ErrInvalidWavFile
+}
+
+// Decode decodes the sequence in a WAV file with a new Decoder. To decode
+// many files, decode them with the same Decoder.
+func Decode(r io.ReadSeeker) (*Sequence, error) {
+	return DecodeContext(context.Background(), r)
+}
+
+// DecodeContext decodes the sequence in a WAV file, returning the context's
+// error as soon as it notices ctx is done.
+func DecodeContext(ctx context.Context, r io.ReadSeeker) (*Sequence, error) {
+	return NewDecoder().DecodeContext(ctx, r)
+}
+
+// decodeSequence decodes the sequence in a WAV file with the given options.
+func decodeSequence(ctx context.Context, r io.ReadSeeker, opts decodeOptions) (*Sequence, error) {
+	decoder := wav.NewDecoder(r)
+	if err := checkWavFile(decoder); err != nil {
+		return nil, err
+	}
+
+	result, err := generateWavBytes(ctx, decoder, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.parseBytes(result.Bytes)
+}
+
+// embedRawBytes sets the Raw field of the sequence and each of its lines to
+// the bytes they were parsed from, so the parsed fields can be checked
+// against the bytes by hand. The data must be what the sequence was parsed
+// from.
+func embedRawBytes(sequence *Sequence, data []byte) {
+	sequence.Raw = hexBytes(data)
+
+	embed := func(notes []NoteLine, offset int) {
+		for i := range notes {
+			length := 3
+			if notes[i].Bar {
+				length = 1
+			}
+
+			notes[i].Raw = hexBytes(data[offset : offset+length])
+			offset += length
+		}
+	}
+
+	embed(sequence.Channel1Notes, 6)
+	embed(sequence.Channel2Notes, 6+sequence.Channel1LineCount+3)
+}
+
+// hexBytes formats bytes as space separated hex.
+func hexBytes(data []byte) string {
+	var sb strings.Builder
+
+	for i, b := range data {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(fmt.Sprintf("%02X", b))
+	}
+
+	return sb.String()
+}
+
+// sum returns the sum of the elements in the slice.
+func sum(slice []int) int {
+	total := 0
+	for _, v := range slice {
+		total += v
+	}
+	return total
+}
+
+// Sequence is a decoded save: its header and the notes in each channel. Its
+// JSON fields are snake_case, see jsonstyle.go for the Go field names older
+// files were written with.
+//
+// The header is embedded, so its fields are written alongside the notes in
+// the JSON, as they always have been, and can be used as fields of the
+// Sequence.
+type Sequence struct {
+	Header
+	Channel1Notes []NoteLine `json:"channel_1_notes"`
+	Channel2Notes []NoteLine `json:"channel_2_notes"`
+	// Raw is the hex dump of the decoded bytes, only set with -embed-bytes.
+	Raw string `json:"raw,omitempty"`
+}
+
+// Header is everything in a save other than the notes: the magic byte and
+// program number, and the line counts and checksums of each channel, along
+// with the checksums worked out from the notes. New details about a sequence
+// that aren't notes belong here too.
+type Header struct {
+	MagicByte                 byte `json:"magic_byte"`
+	ProgramNumber             int  `json:"program_number"`
+	NumChannels               int  `json:"num_channels"`
+	Channel1LineCount         int  `json:"channel_1_line_count"`
+	Channel1Checksum          byte `json:"channel_1_checksum"`
+	Channel1ChecksumByte      byte `json:"channel_1_checksum_byte"`
+	Channel2LineCount         int  `json:"channel_2_line_count"`
+	Channel2AdjustedLineCount int  `json:"channel_2_adjusted_line_count"`
+	Channel2Checksum          byte `json:"channel_2_checksum"`
+	Channel2ChecksumByte      byte `json:"channel_2_checksum_byte"`
+}
+
+type NoteLine struct {
+	NoteNum    int    `json:"note_num"`
+	NoteName   string `json:"note_name"`
+	Octave     int    `json:"octave"`
+	StepLength int    `json:"step_length"`
+	GateLength int    `json:"gate_length"`
+	Portamento bool   `json:"portamento"`
+	Accent     bool   `json:"accent"`
+	Bar        bool   `json:"bar"`
+	// Raw is the hex dump of the bytes the line was parsed from, only set
+	// with -embed-bytes.
+	Raw string `json:"raw,omitempty"`
+}
+
+type Note struct {
+	NoteNum  int
+	NoteName string
+	Octave   int
+}
+
+// findChannelBoundary works out the channel 1 line count from the structure of
+// the save rather than the stored count: channel 2 runs to the end of the data,
+// starts with the total line count, which has to match the length of the data,
+// and has to checksum. None of that depends on the channel 1 line count, so a
+// corrupt count can be caught before it throws off the whole of channel 2. It
+// returns false if there isn't exactly one place the boundary could be.
+func findChannelBoundary(data []byte) (int, bool) {
+	if len(data) < 10 {
+		return 0, false
+	}
+
+	total := len(data) - 10
+	boundary := -1
+
+	// i is the index of the channel 1 checksum byte
+	for i := 6; i+4 <= len(data); i++ {
+		if lineCountAt(data, i+1) != total {
+			continue
+		}
+
+		var checksum int8
+		for _, b := range data[i+1:] {
+			checksum += int8(b)
+		}
+
+		if checksum != 0 {
+			continue
+		}
+
+		if boundary != -1 {
+			return 0, false
+		}
+
+		boundary = i - 6
+	}
+
+	return boundary, boundary != -1
+}
+
+// lineCountAt returns the line count stored in the two bytes at data[i].
+//
+// Line counts are stored big endian, high byte first. That's what every unit
+// we've had a save from writes: the known dumps have line counts like 00 0A,
+// which read little endian would be 2560 lines for a ten line channel. Every
+// line count is read through here and written through appendLineCount, so
+// if a unit ever turns up that does it the other way, this is the one place
+// to change.
+func lineCountAt(data []byte, i int) int {
+	return int(binary.BigEndian.Uint16(data[i : i+2]))
+}
+
+// appendLineCount appends a line count to data the way lineCountAt reads it.
+// The count has to fit in the two bytes, which encodeSequence checks before
+// it writes anything.
+func appendLineCount(data []byte, lineCount int) []byte {
+	return binary.BigEndian.AppendUint16(data, uint16(lineCount))
+}
+
+// checkLineStructure walks a channel's lines the way parseBytes reads them, a
+// bar at a time or a note at a time, and checks that they end exactly where
+// the line count says. A note that runs past the end means the line count or
+// the lines are corrupt, and the error gives the line and byte it started at.
+func checkLineStructure(data []byte, channel, start, lineCount int) error {
+	line := 0
+
+	for line < lineCount {
+		if data[start+line] == barByte {
+			line++
+			continue
+		}
+
+		if line+3 > lineCount {
+			return fmt.Errorf("validation failed - %w, channel %d: the note at line %d (byte %d) runs past the %d lines counted", ErrLineCountMismatch, channel, line, start+line, lineCount)
+		}
+
+		line += 3
+	}
+
+	return nil
+}
+
+// validateBytes checks that data is a save the MC-202 could have written, laid
+// out as described on parseBytes, and returns the first problem it finds.
+func validateBytes(data []byte) error {
+	return defaultSequenceOptions.validateBytes(data)
+}
+
+// validateBytes is validateBytes with the line count limit of the options.
+func (o sequenceOptions) validateBytes(data []byte) error {
+	return checkSaveBytes(data, o.maxLineCount, false)
+}
+
+// validateAllBytes is validateBytes, but carries on past the first problem
+// where it can and returns all of them together with errors.Join. It only
+// stops early at a problem that leaves it no way to find the rest of the
+// bytes: too few bytes or a line count out of range. The errors for each
+// problem are the same as validateBytes returns, so errors.Is and errors.As
+// find them.
+func (o sequenceOptions) validateAllBytes(data []byte) error {
+	return checkSaveBytes(data, o.maxLineCount, true)
+}
+
+// validationErrors collects the problems checkSaveBytes finds.
+type validationErrors struct {
+	all  bool
+	errs []error
+}
+
+// add records a problem and reports whether to stop looking for more.
+func (v *validationErrors) add(err error) bool {
+	v.errs = append(v.errs, err)
+	return !v.all
+}
+
+// err returns the problems found, nil if there weren't any.
+func (v *validationErrors) err() error {
+	if len(v.errs) == 1 {
+		return v.errs[0]
+	}
+
+	return errors.Join(v.errs...)
+}
+
+func checkSaveBytes(data []byte, maxLineCount int, all bool) error {
+	problems := validationErrors{all: all}
+
+	if len(data) < 10 {
+		problems.add(fmt.Errorf("validation failed - %w: %d", ErrTooFewBytes, len(data)))
+		return problems.err()
+	}
+
+	if data[0] != magicByte {
+		if problems.add(fmt.Errorf("validation failed - %w: %02X", ErrInvalidMagicByte, data[0])) {
+			return problems.err()
+		}
+	}
+
+	if int(data[1]) < 0 || int(data[1]) > 9 {
+		if problems.add(fmt.Errorf("validation failed - %w byte 1: %d", ErrInvalidProgramNumber, int(data[1]))) {
+			return problems.err()
+		}
+	}
+
+	if int(data[2]) < 0 || int(data[2]) > 9 {
+		if problems.add(fmt.Errorf("validation failed - %w byte 2: %d", ErrInvalidProgramNumber, int(data[2]))) {
+			return problems.err()
+		}
+	}
+
+	if int(data[3]) < 0 || int(data[3]) > 9 {
+		if problems.add(fmt.Errorf("validation failed - %w byte 3: %d", ErrInvalidProgramNumber, int(data[3]))) {
+			return problems.err()
+		}
+	}
+
+	channel1LineCount := lineCountAt(data, 4)
+
+	if boundary, ok := findChannelBoundary(data); ok && boundary != channel1LineCount {
+		if problems.add(fmt.Errorf("validation failed - %w: line count %d, boundary after %d lines", ErrBoundaryMismatch, channel1LineCount, boundary)) {
+			return problems.err()
+		}
+	}
+
+	if channel1LineCount < 0 || channel1LineCount > maxLineCount {
+		problems.add(fmt.Errorf("validation failed - %w, channel 1: %d", ErrInvalidLineCount, channel1LineCount))
+		return problems.err()
 	}
 
 	if len(data) < 6+channel1LineCount+4 {
-		return fmt.Errorf("validation failed - invalid channel 1 line count, too few lines: %d", len(data))
+		problems.add(fmt.Errorf("validation failed - %w for channel 1 line count: %d", ErrTooFewBytes, len(data)))
+		return problems.err()
 	}
 
 	channel1Bytesum := int8(data[4]) + int8(data[5])
@@ -397,10 +1330,13 @@ func validateBytes(data []byte) error {
 		if data[6+i] != barByte {
 			channel1NoteLines++
 
-			if (channel1NoteLines+1)%3 == 0 {
-				noteNum := int(data[6+i] & 0b00111111)
-				if noteNum < 0 || noteNum > 60 {
-					return fmt.Errorf("validation failed - invalid note number, channel 1, line %d: %d", noteNum, i)
+			// the note number is in the third line of a note
+			if channel1NoteLines%3 == 0 {
+				noteNum := int(data[6+i] & noteNumMask)
+				if noteNum < MinNote || noteNum > MaxNote {
+					if problems.add(&LineError{Err: ErrNoteOutOfRange, Channel: 1, Line: i, Value: noteNum}) {
+						return problems.err()
+					}
 				}
 			}
 		}
@@ -408,24 +1344,44 @@ func validateBytes(data []byte) error {
 
 	channel1Checksum := int8(channel1Bytesum)
 
+	if err := checkLineStructure(data, 1, 6, channel1LineCount); err != nil {
+		if problems.add(err) {
+			return problems.err()
+		}
+	}
+
 	if channel1NoteLines%3 != 0 {
-		return fmt.Errorf("validation failed - invalid number of note lines in channel 1: %d", channel1NoteLines)
+		if problems.add(fmt.Errorf("validation failed - %w in channel 1: %d", ErrInvalidNoteLines, channel1NoteLines)) {
+			return problems.err()
+		}
 	}
 
 	channel1ChecksumByte := int8(data[6+channel1LineCount])
 
-	if channel1ChecksumByte+channel1Checksum != 0 {
-		return fmt.Errorf("validation failed - invalid channel 1 checksum: byte: (%d, %02X) checksum: (%d, %02X)", channel1ChecksumByte, byte(channel1ChecksumByte), channel1Checksum, byte(channel1Checksum))
+	if byte(channel1ChecksumByte) != checksumByte(channel1Checksum) {
+		if problems.add(&ChecksumError{Channel: 1, Stored: channel1ChecksumByte, Computed: channel1Checksum, ProgramNumber: programNumber(data)}) {
+			return problems.err()
+		}
 	}
 
-	channel2LineCount := int(binary.BigEndian.Uint16(data[6+channel1LineCount+1 : 6+channel1LineCount+3]))
+	channel2LineCount := lineCountAt(data, 6+channel1LineCount+1)
 
-	if channel2LineCount < 0 || channel2LineCount > 10000 {
-		return fmt.Errorf("validation failed - invalid channel 2 line count: %d", channel2LineCount)
+	if channel2LineCount < 0 || channel2LineCount > maxLineCount {
+		problems.add(fmt.Errorf("validation failed - %w, channel 2: %d", ErrInvalidLineCount, channel2LineCount))
+		return problems.err()
+	}
+
+	// the total can't be less than channel 1 on its own, or channel 2 would
+	// have a negative number of lines and its checksum would be read from
+	// inside channel 1
+	if channel2LineCount < channel1LineCount {
+		problems.add(fmt.Errorf("validation failed - %w, channel 2: total %d is less than channel 1's %d", ErrInvalidLineCount, channel2LineCount, channel1LineCount))
+		return problems.err()
 	}
 
 	if len(data) < 6+channel2LineCount+4 {
-		return fmt.Errorf("validation failed - invalid channel 2 line count, too few lines: %d", len(data))
+		problems.add(fmt.Errorf("validation failed - %w for channel 2 line count: %d", ErrTooFewBytes, len(data)))
+		return problems.err()
 	}
 
 	channel2Checksum := int8(data[6+channel1LineCount+1]) + int8(data[6+channel1LineCount+2])
@@ -438,10 +1394,13 @@ func validateBytes(data []byte) error {
 		if data[6+channel1LineCount+3+i] != barByte {
 			channel2NoteLines++
 
-			if (channel2NoteLines+1)%3 == 0 {
-				noteNum := int(data[6+channel1LineCount+3+i] & 0b00111111)
-				if noteNum < 0 || noteNum > 60 {
-					return fmt.Errorf("validation failed - invalid note number, channel 2, line %d: %d", noteNum, i)
+			// the note number is in the third line of a note
+			if channel2NoteLines%3 == 0 {
+				noteNum := int(data[6+channel1LineCount+3+i] & noteNumMask)
+				if noteNum < MinNote || noteNum > MaxNote {
+					if problems.add(&LineError{Err: ErrNoteOutOfRange, Channel: 2, Line: i, Value: noteNum}) {
+						return problems.err()
+					}
 				}
 			}
 		}
@@ -449,33 +1408,95 @@ func validateBytes(data []byte) error {
 
 	channel2ChecksumByte := int8(data[6+channel2LineCount+3])
 
+	if err := checkLineStructure(data, 2, 6+channel1LineCount+3, channel2LineCount-channel1LineCount); err != nil {
+		if problems.add(err) {
+			return problems.err()
+		}
+	}
+
 	if channel2NoteLines%3 != 0 {
-		return fmt.Errorf("validation failed - invalid number of note lines in channel 2: %d", channel1NoteLines)
+		if problems.add(fmt.Errorf("validation failed - %w in channel 2: %d", ErrInvalidNoteLines, channel2NoteLines)) {
+			return problems.err()
+		}
+	}
+
+	if byte(channel2ChecksumByte) != checksumByte(channel2Checksum) {
+		if problems.add(&ChecksumError{Channel: 2, Stored: channel2ChecksumByte, Computed: channel2Checksum, ProgramNumber: programNumber(data)}) {
+			return problems.err()
+		}
 	}
 
-	if channel2ChecksumByte+channel2Checksum != 0 {
-		return fmt.Errorf("validation failed - invalid channel 2 checksum: byte: (%d, %02X), checksum: (%d, %02X)", channel2ChecksumByte, byte(channel2ChecksumByte), channel2Checksum, byte(channel2Checksum))
+	return problems.err()
+}
+
+// checkBytes validates the bytes of a save and returns its program number,
+// without parsing the notes. It's all a caller needs to know whether a
+// recording holds a good save and which program it is.
+func checkBytes(data []byte) (int, error) {
+	return defaultSequenceOptions.checkBytes(data)
+}
+
+// checkBytes is checkBytes with the line count limit of the options.
+func (o sequenceOptions) checkBytes(data []byte) (int, error) {
+	if err := o.validateBytes(data); err != nil {
+		return 0, err
 	}
 
-	return nil
+	return programNumber(data), nil
+}
+
+// programNumber returns the program number from its three digits.
+func programNumber(data []byte) int {
+	return int(data[1])*100 + int(data[2])*10 + int(data[3])
 }
 
+// parseBytes validates and parses the bytes of a save into a Sequence.
+//
+// The bytes are laid out as follows, where n1 is the channel 1 line count and
+// n2 is the line count of both channels together:
+//
+//	offset     length   contents
+//	0          1        magic byte (0xE0)
+//	1          3        program number digits, hundreds first
+//	                    (on tape, the 122 bit data buffer goes here)
+//	4          2        channel 1 line count n1, big endian
+//	6          n1       channel 1 lines
+//	6+n1       1        channel 1 checksum byte
+//	6+n1+1     2        total line count n2, big endian
+//	6+n1+3     n2-n1    channel 2 lines
+//	6+n2+3     1        channel 2 checksum byte
+//
+// A line is either a bar (0xFF) or one of the three lines of a note: step
+// length, gate length, then the note byte. Each checksum byte makes the sum of
+// its channel's line count bytes, lines and checksum byte zero.
+//
+// Nothing else is saved. In particular there's no transpose or key setting:
+// the data buffer is a run of one bits rather than bytes, so it can't carry
+// one, and every other byte is accounted for above. Note numbers are the
+// pitches as they were keyed in, and are exported as they are.
 func parseBytes(data []byte) (*Sequence, error) {
-	if err := validateBytes(data); err != nil {
+	return defaultSequenceOptions.parseBytes(data)
+}
+
+// parseBytes is parseBytes with the line count limit of the options.
+func (o sequenceOptions) parseBytes(data []byte) (*Sequence, error) {
+	if err := o.validateBytes(data); err != nil {
 		return nil, err
 	}
 
 	sequence := Sequence{
-		MagicByte:         data[0],
-		ProgramNumber:     int(data[1])*100 + int(data[2])*10 + int(data[3]),
-		NumChannels:       1,
-		Channel1LineCount: int(binary.BigEndian.Uint16(data[4:6])),
+		Header: Header{
+			MagicByte:         data[0],
+			ProgramNumber:     programNumber(data),
+			NumChannels:       1,
+			Channel1LineCount: lineCountAt(data, 4),
+		},
 	}
 
 	channel1Checksum := int8(data[4]) + int8(data[5])
 
 	for i := 0; i < sequence.Channel1LineCount; i++ { // Reserve the last 4 bytes for checksum byte, line count, and parity byte
-		if data[i] == barByte {
+		if data[6+i] == barByte {
 			channel1Checksum += int8(data[6+i])
 
 			sequence.Channel1Notes = append(sequence.Channel1Notes, NoteLine{Bar: true})
@@ -486,7 +1507,10 @@ func parseBytes(data []byte) (*Sequence, error) {
 		channel1Checksum += int8(data[6+i+1])
 		channel1Checksum += int8(data[6+i+2])
 
-		noteNum := int(data[6+i+2] & 0b00111111)
+		noteNum := int(data[6+i+2] & noteNumMask)
+		if noteNum > MaxNote {
+			return nil, &LineError{Err: ErrNoteOutOfRange, Channel: 1, Line: i + 2, Value: noteNum}
+		}
 
 		sequence.Channel1Notes = append(sequence.Channel1Notes, NoteLine{
 			NoteNum:    noteNum,
@@ -494,8 +1518,8 @@ func parseBytes(data []byte) (*Sequence, error) {
 			Octave:     noteMap[noteNum].Octave,
 			StepLength: int(data[6+i]),
 			GateLength: int(data[6+i+1]),
-			Portamento: data[6+i+2]&0b10000000 != 0,
-			Accent:     data[6+i+2]&0b01000000 != 0,
+			Portamento: data[6+i+2]&portamentoMask != 0,
+			Accent:     data[6+i+2]&accentMask != 0,
 		})
 		i += 2 // Skip the next three bytes since they are part of the same note
 		// The for loop takes care of incrementing i by 1
@@ -505,15 +1529,15 @@ func parseBytes(data []byte) (*Sequence, error) {
 	sequence.Channel1ChecksumByte = data[6+sequence.Channel1LineCount]
 
 	// Channel 2
-	sequence.Channel2LineCount = int(binary.BigEndian.Uint16(data[6+sequence.Channel1LineCount+1 : 6+sequence.Channel1LineCount+3]))
+	sequence.Channel2LineCount = lineCountAt(data, 6+sequence.Channel1LineCount+1)
 	sequence.Channel2AdjustedLineCount = sequence.Channel2LineCount - sequence.Channel1LineCount
 
-	if sequence.Channel1LineCount != sequence.Channel2LineCount && sequence.Channel1LineCount != 0 {
+	// channel 2 can hold notes with channel 1 empty, a pattern with only the
+	// second part, so it's the lines in channel 2 that say there are two
+	if sequence.Channel2AdjustedLineCount > 0 {
 		sequence.NumChannels = 2
 	}
 
-	sequence.Channel2ChecksumByte = data[6+sequence.Channel1LineCount+3]
-
 	channel2Checksum := int8(data[6+sequence.Channel1LineCount+1]) + int8(data[6+sequence.Channel1LineCount+2])
 
 	for i := 0; i < sequence.Channel2AdjustedLineCount; i++ {
@@ -528,7 +1552,10 @@ func parseBytes(data []byte) (*Sequence, error) {
 		channel2Checksum += int8(data[6+sequence.Channel1LineCount+3+i+1])
 		channel2Checksum += int8(data[6+sequence.Channel1LineCount+3+i+2])
 
-		noteNum := int(data[6+sequence.Channel1LineCount+3+i+2] & 0b00111111)
+		noteNum := int(data[6+sequence.Channel1LineCount+3+i+2] & noteNumMask)
+		if noteNum > MaxNote {
+			return nil, &LineError{Err: ErrNoteOutOfRange, Channel: 2, Line: i + 2, Value: noteNum}
+		}
 
 		sequence.Channel2Notes = append(sequence.Channel2Notes, NoteLine{
 			NoteNum:    noteNum,
@@ -536,8 +1563,8 @@ func parseBytes(data []byte) (*Sequence, error) {
 			Octave:     noteMap[noteNum].Octave,
 			StepLength: int(data[6+sequence.Channel1LineCount+3+i]),
 			GateLength: int(data[6+sequence.Channel1LineCount+3+i+1]),
-			Portamento: data[6+sequence.Channel1LineCount+3+i+2]&0b10000000 != 0,
-			Accent:     data[6+sequence.Channel1LineCount+3+i+2]&0b01000000 != 0,
+			Portamento: data[6+sequence.Channel1LineCount+3+i+2]&portamentoMask != 0,
+			Accent:     data[6+sequence.Channel1LineCount+3+i+2]&accentMask != 0,
 		})
 
 		i += 2 // Skip the next three bytes since they are part of the same note
@@ -550,6 +1577,125 @@ func parseBytes(data []byte) (*Sequence, error) {
 	return &sequence, nil
 }
 
+// Equal reports whether two sequences are musically the same: they have the
+// same program number and number of channels, and the same notes and bars in
+// each channel. Note names and octaves follow from the note numbers so aren't
+// compared, and neither are the line counts and checksums, which follow from
+// the notes, or Raw. Use EqualWithChecksums to compare the checksums too.
+func (s *Sequence) Equal(other *Sequence) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+
+	return s.ProgramNumber == other.ProgramNumber &&
+		s.NumChannels == other.NumChannels &&
+		slices.EqualFunc(s.Channel1Notes, other.Channel1Notes, NoteLine.Equal) &&
+		slices.EqualFunc(s.Channel2Notes, other.Channel2Notes, NoteLine.Equal)
+}
+
+// Clone returns a copy of the sequence that shares nothing with it, so the
+// copy's notes can be changed without changing the original's.
+func (s *Sequence) Clone() *Sequence {
+	if s == nil {
+		return nil
+	}
+
+	clone := *s
+	clone.Channel1Notes = slices.Clone(s.Channel1Notes)
+	clone.Channel2Notes = slices.Clone(s.Channel2Notes)
+
+	return &clone
+}
+
+// EqualWithChecksums reports whether two sequences are Equal and have the
+// same computed and stored checksums.
+func (s *Sequence) EqualWithChecksums(other *Sequence) bool {
+	return s.Equal(other) &&
+		(s == nil || s.Channel1Checksum == other.Channel1Checksum &&
+			s.Channel1ChecksumByte == other.Channel1ChecksumByte &&
+			s.Channel2Checksum == other.Channel2Checksum &&
+			s.Channel2ChecksumByte == other.Channel2ChecksumByte)
+}
+
+// Equal reports whether two lines are the same bar, or the same note: the
+// same note number, step and gate lengths, portamento and accent.
+func (n NoteLine) Equal(other NoteLine) bool {
+	if n.Bar || other.Bar {
+		return n.Bar == other.Bar
+	}
+
+	return n.NoteNum == other.NoteNum &&
+		n.StepLength == other.StepLength &&
+		n.GateLength == other.GateLength &&
+		n.Portamento == other.Portamento &&
+		n.Accent == other.Accent
+}
+
+// PitchRange returns the lowest and highest notes across both channels. ok is
+// false if the sequence has only bars. Notes the MC-202 can't play are left
+// out.
+func (s *Sequence) PitchRange() (low, high Note, ok bool) {
+	for _, notes := range [][]NoteLine{s.Channel1Notes, s.Channel2Notes} {
+		for _, note := range notes {
+			if note.Bar || note.NoteNum < MinNote || note.NoteNum > MaxNote {
+				continue
+			}
+
+			if !ok || note.NoteNum < low.NoteNum {
+				low = noteMap[note.NoteNum]
+			}
+
+			if !ok || note.NoteNum > high.NoteNum {
+				high = noteMap[note.NoteNum]
+			}
+
+			ok = true
+		}
+	}
+
+	return low, high, ok
+}
+
+// Counts returns the number of notes and bars in each channel. A note is one
+// entry in the notes even though it's stored as three lines, a step, a gate
+// and a note byte, where a bar is stored as one, so the line counts can't be
+// used for this.
+func (s *Sequence) Counts() (ch1Notes, ch1Bars, ch2Notes, ch2Bars int) {
+	count := func(lines []NoteLine) (notes, bars int) {
+		for _, line := range lines {
+			if line.Bar {
+				bars++
+			} else {
+				notes++
+			}
+		}
+
+		return notes, bars
+	}
+
+	ch1Notes, ch1Bars = count(s.Channel1Notes)
+	ch2Notes, ch2Bars = count(s.Channel2Notes)
+
+	return ch1Notes, ch1Bars, ch2Notes, ch2Bars
+}
+
+// String returns the note's name and octave, such as C#3.
+func (n Note) String() string {
+	return fmt.Sprintf("%s%d", n.NoteName, n.Octave)
+}
+
+// Frequency returns the note's pitch in hertz at concert pitch, where note 45,
+// A4, is 440Hz.
+func (n Note) Frequency() float64 {
+	return 440 * math.Pow(2, float64(n.NoteNum-45)/12)
+}
+
+// CV returns the control voltage the MC-202 puts out for the note, one volt
+// per octave above note 0.
+func (n Note) CV() float64 {
+	return float64(n.NoteNum) / 12
+}
+
 func (s *Sequence) String() string {
 	var sb strings.Builder
 
@@ -557,6 +1703,14 @@ func (s *Sequence) String() string {
 	sb.WriteString(fmt.Sprintf("Program Number: %d\n", s.ProgramNumber))
 	sb.WriteString(fmt.Sprintf("Number of Channels: %d\n", s.NumChannels))
 
+	if low, high, ok := s.PitchRange(); ok {
+		sb.WriteString(fmt.Sprintf("Pitch Range: %s - %s\n", low, high))
+	}
+
+	ch1Notes, ch1Bars, ch2Notes, ch2Bars := s.Counts()
+	sb.WriteString(fmt.Sprintf("Channel 1: %d notes, %d bars\n", ch1Notes, ch1Bars))
+	sb.WriteString(fmt.Sprintf("Channel 2: %d notes, %d bars\n", ch2Notes, ch2Bars))
+
 	sb.WriteString(fmt.Sprintf("Channel 1 Line Count: %d\n", s.Channel1LineCount))
 	sb.WriteString("Channel 1 Notes:")
 	for _, note := range s.Channel1Notes {
@@ -629,7 +1783,29 @@ func generateSamples(freq int, cycles int, amplitude float64) []int {
 	return samples
 }
 
+// fileSubcommands are the subcommands that work on a file: clean decodes it
+// and re-encodes it to a fresh wav file, verify checks that it decodes to a
+// valid sequence without parsing it.
+var fileSubcommands = []string{"clean", "verify"}
+
 func main() {
+	// selftest has flags of its own and doesn't work on a file
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelfTest(os.Args[2:])
+		return
+	}
+
+	// the file subcommands work on the file given after them, with the same
+	// flags as decoding, given before it:
+	//
+	//	mc-202-librarian clean [flags] file
+	args := os.Args[1:]
+
+	var subcommand string
+	if len(args) > 0 && slices.Contains(fileSubcommands, args[0]) {
+		subcommand, args = args[0], args[1:]
+	}
+
 	encodePtr := flag.Bool("encode", false, "encode a file")
 
 	decodePtr := flag.Bool("decode", false, "decode a file")
@@ -638,290 +1814,1444 @@ func main() {
 
 	fileNamePtr := flag.String("file", "", "file to encode/decode")
 
-	flag.Parse()
+	dumpBitsPtr := flag.String("dump-bits", "", "write the decoded sign change bits to a file")
 
-	if *encodePtr && *decodePtr {
-		fmt.Println("cannot encode and decode at the same time")
-		os.Exit(1)
-	}
+	bitsImagePtr := flag.String("bits-image", "", "with -decode, draw the sign change bits to a PNG file a bit period to a row, with the rows of each decoded byte marked")
 
-	if !*encodePtr && !*decodePtr {
-		fmt.Println("must specify encode or decode")
-		os.Exit(1)
-	}
+	fromBitsPtr := flag.String("from-bits", "", "decode a file of sign change bits instead of a wav file")
 
-	if fileNamePtr == nil || *fileNamePtr == "" {
-		fmt.Println("must specify a file")
-		os.Exit(1)
-	}
+	packedBitsPtr := flag.Bool("packed-bits", false, "with -from-bits, the file has eight bits to a byte, most significant first, rather than a 0 or 1 on each line as -dump-bits writes them")
 
-	if *encodePtr {
-		// encode
-		samples := generateSequenceFile(*fileNamePtr)
+	rawPCMPtr := flag.Bool("raw-pcm", false, "decode a file of raw little-endian PCM samples with no wav header, needs -rate, -bit-depth and -pcm-channels")
 
-		name := path.Join("./encoded", strings.TrimSuffix(*fileNamePtr, ".json")) + ".wav"
+	bitDepthPtr := flag.Int("bit-depth", 0, "with -raw-pcm, bits per sample: "+rawPCMBitDepthNames())
 
-		f, err := os.Create(name)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		defer f.Close()
+	pcmChannelsPtr := flag.Int("pcm-channels", 0, "with -raw-pcm, number of interleaved channels, the first is decoded")
 
-		enc := wav.NewEncoder(f, sampleRate, 16, 1, 1)
-		defer enc.Close()
+	ratePtr := flag.Int("rate", sampleRate, "sample rate the sign change bits were generated at")
 
-		buf := &audio.IntBuffer{Data: samples, Format: &audio.Format{SampleRate: sampleRate, NumChannels: 1}}
+	labelPtr := flag.String("label", "", "label to store in the encoded wav file's metadata, defaults to the file name")
 
-		if err := enc.Write(buf); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+	dryRunPtr := flag.Bool("dry-run", false, "print the bytes an encode would produce without writing a wav file")
 
-		return
-	}
+	compareStrategiesPtr := flag.Bool("compare-strategies", false, "decode a file with every decode strategy and compare the results")
 
-	if *decodePtr {
-		waveFile, err := os.Open(*fileNamePtr)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		defer waveFile.Close()
+	joinPtr := flag.Bool("join", false, "encode the JSON files given as arguments one after another to the -out wav file")
 
-		decoder := wav.NewDecoder(waveFile)
-		if !decoder.IsValidFile() {
-			fmt.Println("invalid wav file")
-			os.Exit(1)
-		}
+	listNotesPtr := flag.Bool("list-notes", false, "print every note number with the note byte it's saved as and its name")
+	flatsPtr := flag.Bool("flats", false, "spell the black keys as flats in -list-notes")
 
-		sampleRate := decoder.SampleRate
+	explainChecksumPtr := flag.Bool("explain-checksum", false, "decode a file and show how each channel's checksum is worked out")
 
-		signBits, err := generateSignChangeBits(decoder, false)
-		if err != nil {
-			fmt.Println("problem generating sign change bits:", err)
-			os.Exit(1)
-		}
+	fingerprintPtr := flag.Bool("fingerprint", false, "print a digest of the notes in a wav or JSON file that's the same for every copy of the save, for finding duplicates")
 
-		bytes, err := generateBytes(signBits, int(sampleRate))
-		if err != nil {
-			fmt.Println(err)
-			fmt.Println("trying again with offset...")
+	outPtr := flag.String("out", "", "file to write to")
 
-			signBits, err = generateSignChangeBits(decoder, true)
-			if err != nil {
-				fmt.Println("problem generating sign change bits:", err)
-				os.Exit(1)
-			}
+	statsPtr := flag.Bool("stats", false, "print statistics about the quality of the recording")
 
-			bytes, err = generateBytes(signBits, int(sampleRate))
-			if err != nil {
-				fmt.Print("second attempt at generating bytes failed:", err)
-				os.Exit(1)
-			}
-		}
+	embedBytesPtr := flag.Bool("embed-bytes", false, "include the raw decoded bytes, and the bytes of each line, in the json output")
 
-		fmt.Println("Success!")
+	takesPtr := flag.Bool("takes", false, "decode every take of a sequence recorded several times and majority vote the bytes, even if the recording doesn't decode as a whole")
 
-		fmt.Println()
+	referencePtr := flag.String("reference", "", "decode a file and score it against this JSON file of what it should hold")
 
-		for _, b := range bytes {
-			fmt.Printf("%02X ", b)
-		}
+	thresholdPtr := flag.Float64("threshold", 100, "with -reference, the accuracy as a percentage below which to exit with an error")
 
-		fmt.Println()
-		fmt.Println()
+	scanMagicPtr := flag.Bool("scan-magic", false, "list every place in a file where the magic byte is followed by a program number, for files that won't decode")
 
-		sequence, err := parseBytes(bytes)
+	indexPtr := flag.String("index", "", "with -dir, write a catalogue of the wav and JSON files in the directory to this file, as CSV if it ends in .csv and JSON otherwise")
+
+	dirPtr := flag.String("dir", "", "decode every wav file, or encode every JSON file, in a directory")
+
+	overwritePtr := flag.Bool("overwrite", false, "with -dir, process files that were already processed")
+
+	retryFailedPtr := flag.Bool("retry-failed", false, "with -dir, only process files that previously failed")
+
+	prgPtr := flag.String("prg", "", "with -decode, write the decoded bytes to this file as a raw program dump")
+
+	sharePtr := flag.Bool("share", false, "with -decode, print the decoded bytes as a share code that can be pasted into a message")
+
+	fromSharePtr := flag.String("from-share", "", "encode the save in a share code instead of a json file")
+
+	partialPtr := flag.Bool("partial", false, "with -decode, write the notes read from a recording that was cut off to a json file")
+
+	pitchesPtr := flag.Bool("pitches", false, "with -decode, print just the pitches of each channel's notes in order, with | for each bar")
+
+	interleavePtr := flag.Bool("interleave", false, "with -pitches, print both channels on one line, a note from each in turn")
+
+	musicXMLPtr := flag.String("musicxml", "", "with -decode, write the notes to this file as MusicXML for notation software")
+
+	tempoPtr := flag.Float64("tempo", 120, "with -musicxml, the tempo in beats per minute")
+
+	annotatePtr := flag.Bool("annotate", false, "print a table of the decoded bytes with what each of them is")
+
+	profilePtr := flag.Bool("profile", false, "with -decode, print how long each stage of the decode took to stderr")
+
+	allErrorsPtr := flag.Bool("all-errors", false, "with -decode, report every problem with bytes that don't validate rather than only the first")
+
+	verbosePtr := flag.Bool("verbose", false, "print more detail about the decode")
+
+	stopCyclesPtr := flag.Int("stop-cycles", oneCycles*2, "cycles of stop bits after each encoded byte, fewer than the default won't decode")
+
+	leaderAmpPtr := flag.Float64("leader-amp", defaultAmplitude, "amplitude of the leader and trailing tones when encoding, as a fraction of full scale")
+
+	dataAmpPtr := flag.Float64("data-amp", defaultAmplitude, "amplitude of the data when encoding, as a fraction of full scale")
+
+	leaderRampPtr := flag.Duration("leader-ramp", 0, "time the leader tone takes to fade in when encoding, e.g. 300ms")
+
+	byteGapPtr := flag.Int("byte-gap", 0, "extra cycles of tone between encoded bytes, for units that need more time between bytes")
+
+	startSecPtr := flag.Float64("start-sec", 0, "start decoding this many seconds into the file")
+
+	endSecPtr := flag.Float64("end-sec", 0, "stop decoding this many seconds into the file, defaults to the end")
+
+	adaptiveClockPtr := flag.Bool("adaptive-clock", false, "re-estimate the bit period from the one bits as the bytes are read, for tapes with bad wow and flutter, which is slower")
+
+	demodPtr := flag.String("demod", "sign", "demodulator to read bits with: "+strings.Join(demodulatorNames, ", "))
+
+	gateCheckPtr := flag.String("gate-check", gateCheckOff, "what to do with notes whose gate is longer than their step: off, warn or error")
+
+	leaderWindowPtr := flag.Duration("leader-window", defaultLeaderWindow, "how far into a file to look for the leader tone before deciding it isn't an MC-202 recording, 0 to decode it regardless")
+
+	leaderTolerancePtr := flag.Float64("leader-tolerance", defaultLeaderTolerance, "how far the leader tone's frequency can be from 2370 Hz, as a fraction of it")
+
+	maxFalseMagicPtr := flag.Int("max-false-magic", -1, "give up on a recording once more than this many magic bytes have turned out not to start a save, -1 for no limit")
+
+	stopBitTolerancePtr := flag.Int("stop-bit-tolerance", 0, "how many weak stop bits to accept in a sequence once the program number has been read, for tapes with the odd dropout")
+
+	maxLinesPtr := flag.Int("max-lines", DefaultMaxLineCount, "the most lines a line count can be before the bytes are rejected")
+
+	jsonStylePtr := flag.String("json-style", jsonStyleSnake, "field names to write JSON files with: snake for snake_case, or go for the Go field names files were written with before, which will be removed in the next release")
+
+	lenientParsePtr := flag.Bool("lenient-parse", false, "clamp note names in JSON files that are out of range or don't match their note number, instead of failing")
+
+	verifyEncodePtr := flag.Bool("verify-encode", false, "decode the encoded audio in memory before writing it and fail if it doesn't decode to the same bytes")
+
+	quietPtr := flag.Bool("quiet", false, "only print the output that was asked for, and errors to stderr")
+
+	channelsPtr := flag.Int("channels", 0, "number of channels to encode (1 or 2), defaults to the channels in the file")
+
+	sampleFormatPtr := flag.String("sample-format", "", "read the samples as this format instead of the one in the header: "+sampleFormatNames())
+
+	hysteresisPtr := flag.Float64("hysteresis", 0, "fraction of full scale (0-1) the signal has to cross zero by to count as a sign change, for noisy or quiet recordings")
+
+	flag.CommandLine.Parse(args)
+
+	if subcommand != "" {
+		if flag.NArg() != 1 || *fileNamePtr != "" {
+			fmt.Fprintf(os.Stderr, "%s needs the file as its only argument, after any flags\n", subcommand)
+			os.Exit(1)
+		}
+
+		*fileNamePtr = flag.Arg(0)
+	}
+
+	quiet = *quietPtr
+
+	sequenceOpts := defaultSequenceOptions
+	sequenceOpts.lenientParse = *lenientParsePtr
+
+	if *jsonStylePtr != jsonStyleSnake && *jsonStylePtr != jsonStyleGo {
+		fmt.Fprintf(os.Stderr, "json style must be %s or %s\n", jsonStyleSnake, jsonStyleGo)
+		os.Exit(1)
+	}
+
+	sequenceOpts.jsonStyle = *jsonStylePtr
+
+	if *maxLinesPtr < 0 || *maxLinesPtr > 0xFFFF {
+		fmt.Fprintln(os.Stderr, "max lines must be between 0 and 65535")
+		os.Exit(1)
+	}
+
+	sequenceOpts.maxLineCount = *maxLinesPtr
+
+	if *stopBitTolerancePtr < 0 {
+		fmt.Fprintln(os.Stderr, "stop bit tolerance can't be negative")
+		os.Exit(1)
+	}
+
+	if !slices.Contains([]string{gateCheckOff, gateCheckWarn, gateCheckError}, *gateCheckPtr) {
+		fmt.Fprintf(os.Stderr, "gate check must be %s, %s or %s\n", gateCheckOff, gateCheckWarn, gateCheckError)
+		os.Exit(1)
+	}
+
+	sequenceOpts.gateCheck = *gateCheckPtr
+
+	if *stopCyclesPtr < 1 || *byteGapPtr < 0 {
+		fmt.Fprintln(os.Stderr, "stop cycles must be at least 1 and the byte gap can't be negative")
+		os.Exit(1)
+	}
+
+	if *stopCyclesPtr < oneCycles*2 {
+		fmt.Fprintf(os.Stderr, "warning: fewer than %d stop cycles can't be decoded by this tool\n", oneCycles*2)
+	}
+
+	opts := defaultEncodeOptions
+	opts.sequenceOptions = sequenceOpts
+	opts.stopCycles = *stopCyclesPtr
+	opts.gapCycles = *byteGapPtr
+
+	if *leaderRampPtr < 0 || *leaderRampPtr > maxLeaderRamp {
+		fmt.Fprintf(os.Stderr, "leader ramp must be between 0 and %v\n", maxLeaderRamp)
+		os.Exit(1)
+	}
+
+	opts.leaderRamp = *leaderRampPtr
+	opts.verify = *verifyEncodePtr
+
+	if *leaderAmpPtr <= 0 || *leaderAmpPtr > 1 || *dataAmpPtr <= 0 || *dataAmpPtr > 1 {
+		fmt.Fprintln(os.Stderr, "leader and data amplitudes must be more than 0 and at most 1")
+		os.Exit(1)
+	}
+
+	opts.leaderAmplitude = *leaderAmpPtr
+	opts.dataAmplitude = *dataAmpPtr
+
+	if *hysteresisPtr < 0 || *hysteresisPtr >= 1 {
+		fmt.Fprintln(os.Stderr, "hysteresis must be at least 0 and less than 1")
+		os.Exit(1)
+	}
+
+	if *leaderWindowPtr < 0 || *leaderTolerancePtr <= 0 || *leaderTolerancePtr >= 1 {
+		fmt.Fprintln(os.Stderr, "leader window must be at least 0 and leader tolerance more than 0 and less than 1")
+		os.Exit(1)
+	}
+
+	if _, ok := sampleFormats[*sampleFormatPtr]; *sampleFormatPtr != "" && !ok {
+		fmt.Fprintln(os.Stderr, "sample format must be one of", sampleFormatNames())
+		os.Exit(1)
+	}
+
+	if !slices.Contains(demodulatorNames, *demodPtr) {
+		fmt.Fprintln(os.Stderr, "demodulator must be one of", strings.Join(demodulatorNames, ", "))
+		os.Exit(1)
+	}
+
+	decodeOpts := defaultDecodeOptions
+	decodeOpts.hysteresis = *hysteresisPtr
+	decodeOpts.sampleFormat = *sampleFormatPtr
+	decodeOpts.startSec = *startSecPtr
+	decodeOpts.endSec = *endSecPtr
+	decodeOpts.demod = *demodPtr
+	decodeOpts.partial = *partialPtr
+	decodeOpts.adaptiveClock = *adaptiveClockPtr
+	decodeOpts.leaderWindow = *leaderWindowPtr
+	decodeOpts.leaderTolerance = *leaderTolerancePtr
+	decodeOpts.takes = *takesPtr
+	decodeOpts.stopBitTolerance = *stopBitTolerancePtr
+	decodeOpts.maxFalseMagic = *maxFalseMagicPtr
+	decodeOpts.sequenceOptions = sequenceOpts
+	decodeOpts.buffers = NewDecoder()
+
+	if *profilePtr {
+		decodeOpts.profile = newDecodeProfile()
+	}
+
+	if *fromBitsPtr != "" {
+		if *encodePtr {
+			fmt.Fprintln(os.Stderr, "cannot encode from sign change bits")
+			os.Exit(1)
+		}
+
+		*decodePtr = true
+	}
+
+	var rawFormat rawPCMFormat
+
+	if *rawPCMPtr {
+		if *encodePtr || *fromBitsPtr != "" {
+			fmt.Fprintln(os.Stderr, "can only decode raw PCM from a file given with -file")
+			os.Exit(1)
+		}
+
+		rateSet := false
+		flag.Visit(func(f *flag.Flag) {
+			rateSet = rateSet || f.Name == "rate"
+		})
+
+		rawFormat = rawPCMFormat{rate: *ratePtr, bitDepth: *bitDepthPtr, channels: *pcmChannelsPtr}
+		if !rateSet {
+			rawFormat.rate = 0
+		}
+
+		if err := rawFormat.check(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		*decodePtr = true
+	}
+
+	if *fromSharePtr != "" {
+		if *decodePtr {
+			fmt.Fprintln(os.Stderr, "cannot decode a share code, use -from-share on its own to encode it")
+			os.Exit(1)
+		}
+
+		*encodePtr = true
+	}
+
+	var modes []string
+
+	for _, mode := range []struct {
+		name string
+		set  bool
+	}{
+		{"-encode", *encodePtr},
+		{"-decode", *decodePtr},
+		{"-compare-strategies", *compareStrategiesPtr},
+		{"clean", subcommand == "clean"},
+		{"verify", subcommand == "verify"},
+		{"-join", *joinPtr},
+		{"-explain-checksum", *explainChecksumPtr},
+		{"-index", *indexPtr != ""},
+		{"-scan-magic", *scanMagicPtr},
+		{"-reference", *referencePtr != ""},
+		{"-list-notes", *listNotesPtr},
+		{"-fingerprint", *fingerprintPtr},
+	} {
+		if mode.set {
+			modes = append(modes, mode.name)
+		}
+	}
+
+	if len(modes) > 1 {
+		fmt.Fprintln(os.Stderr, "cannot use", strings.Join(modes, " and "), "at the same time")
+		os.Exit(1)
+	}
+
+	if len(modes) == 0 {
+		fmt.Fprintln(os.Stderr, "must specify encode or decode, or run a subcommand:", strings.Join(append([]string{"selftest"}, fileSubcommands...), ", "))
+		os.Exit(1)
+	}
+
+	if *listNotesPtr {
+		printNoteTable(*flatsPtr)
+		return
+	}
+
+	if *joinPtr {
+		if flag.NArg() == 0 || *outPtr == "" {
+			fmt.Fprintln(os.Stderr, "-join needs the JSON files to join as arguments and a file to write to with -out")
+			os.Exit(1)
+		}
+
+		if err := joinFiles(flag.Args(), *outPtr, *channelsPtr, opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		logln("joined wav file written to", *outPtr)
+		return
+	}
+
+	if *indexPtr != "" {
+		if *dirPtr == "" {
+			fmt.Fprintln(os.Stderr, "-index needs a directory to catalogue with -dir")
+			os.Exit(1)
+		}
+
+		if err := writeIndex(*dirPtr, *indexPtr, decodeOpts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		logln("index written to", *indexPtr)
+		return
+	}
+
+	if *dirPtr != "" {
+		var err error
+
+		switch {
+		case *decodePtr:
+			err = batchDecode(*dirPtr, decodeOpts, *overwritePtr, *retryFailedPtr)
+		case *encodePtr:
+			err = batchEncode(*dirPtr, *channelsPtr, opts, *overwritePtr, *retryFailedPtr)
+		default:
+			fmt.Fprintln(os.Stderr, "-dir is only supported when encoding or decoding")
+			os.Exit(1)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if (fileNamePtr == nil || *fileNamePtr == "") && *fromBitsPtr == "" && *fromSharePtr == "" {
+		fmt.Fprintln(os.Stderr, "must specify a file")
+		os.Exit(1)
+	}
+
+	if *compareStrategiesPtr {
+		compareStrategies(*fileNamePtr, decodeOpts)
+		return
+	}
+
+	if *scanMagicPtr {
+		scanMagic(*fileNamePtr, decodeOpts)
+		return
+	}
+
+	if *referencePtr != "" {
+		accuracy, err := scoreFile(*fileNamePtr, *referencePtr, decodeOpts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if accuracy < *thresholdPtr {
+			fmt.Fprintf(os.Stderr, "accuracy %.1f%% is below the %.1f%% threshold\n", accuracy, *thresholdPtr)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *explainChecksumPtr {
+		result := decodeWavFile(*fileNamePtr, decodeOpts)
+
+		if err := explainChecksums(result.Bytes); err != nil {
+			fmt.Fprintln(os.Stderr, "problem explaining checksums:", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *fingerprintPtr {
+		fingerprint, err := fingerprintFile(*fileNamePtr, decodeOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *fileNamePtr, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s  %s\n", fingerprint, *fileNamePtr)
+		return
+	}
+
+	if subcommand == "verify" {
+		start := time.Now()
+
+		program, err := verifyFile(*fileNamePtr, decodeOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *fileNamePtr, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s: ok, program %03d\n", *fileNamePtr, program)
+
+		if *verbosePtr {
+			fmt.Printf("Verified in %v without parsing the notes\n", time.Since(start).Round(time.Millisecond))
+		}
+
+		return
+	}
+
+	if subcommand == "clean" {
+		outName := *outPtr
+		if outName == "" {
+			outName = strings.TrimSuffix(*fileNamePtr, ".wav") + "_clean.wav"
+		}
+
+		cleanFile(*fileNamePtr, outName, decodeOpts, opts)
+		return
+	}
+
+	if *fromSharePtr != "" {
+		data, err := parseShareCode(*fromSharePtr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if *dryRunPtr {
+			if err := printLayout(data, opts); err != nil {
+				fmt.Fprintln(os.Stderr, "problem validating bytes:", err)
+				os.Exit(1)
+			}
+
+			return
+		}
+
+		program := programNumber(data)
+
+		name := *outPtr
+		if name == "" {
+			name = path.Join("./encoded", fmt.Sprintf("share_%03d.wav", program))
+		}
+
+		label := *labelPtr
+		if label == "" {
+			label = fmt.Sprintf("program %03d", program)
+		}
+
+		if err := writeSequenceWav(name, data, opts, sequenceMetadata(program, label)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		logln("share code encoded to", name)
+
+		return
+	}
+
+	if *encodePtr && *dryRunPtr {
+		sequence := readSequenceFile(*fileNamePtr, opts)
+
+		data, err := opts.encodeSequence(sequence, *channelsPtr)
 		if err != nil {
-			fmt.Println("problem parsing bytes:", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if err := printLayout(data, opts); err != nil {
+			fmt.Fprintln(os.Stderr, "problem validating bytes:", err)
 			os.Exit(1)
 		}
 
-		_ = sequence
+		return
+	}
+
+	if *encodePtr {
+		// encode
+		sequence, data := generateSequenceFile(*fileNamePtr, *channelsPtr, opts)
+
+		name := path.Join("./encoded", strings.TrimSuffix(*fileNamePtr, ".json")) + ".wav"
+
+		label := *labelPtr
+		if label == "" {
+			label = strings.TrimSuffix(path.Base(*fileNamePtr), ".json")
+		}
+
+		if err := writeSequenceWav(name, data, opts, sequenceMetadata(sequence.ProgramNumber, label)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *decodePtr {
+		var (
+			result *DecodeResult
+			name   string
+		)
+
+		if *fromBitsPtr != "" {
+			result = decodeBitsFile(*fromBitsPtr, *packedBitsPtr, *ratePtr, decodeOpts)
+			name = strings.TrimSuffix(*fromBitsPtr, path.Ext(*fromBitsPtr))
+		} else if *rawPCMPtr {
+			result = decodeRawPCMFile(*fileNamePtr, rawFormat, decodeOpts)
+			name = strings.TrimSuffix(*fileNamePtr, path.Ext(*fileNamePtr))
+		} else {
+			result = decodeWavFile(*fileNamePtr, decodeOpts)
+			name = strings.TrimSuffix(*fileNamePtr, ".wav")
+		}
+
+		if *takesPtr {
+			bytes, err := reconcileTakes(result, decodeOpts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "problem reconciling takes:", err)
+				os.Exit(1)
+			}
+
+			result.Bytes = bytes
+			result.Offsets = nil
+		}
+
+		if *dumpBitsPtr != "" {
+			if err := writeBits(*dumpBitsPtr, result.SignBits); err != nil {
+				fmt.Fprintln(os.Stderr, "problem writing sign change bits:", err)
+				os.Exit(1)
+			}
+
+			logln("sign change bits written to", *dumpBitsPtr)
+		}
+
+		if *bitsImagePtr != "" {
+			if err := writeBitsImage(*bitsImagePtr, result); err != nil {
+				fmt.Fprintln(os.Stderr, "problem writing bits image:", err)
+				os.Exit(1)
+			}
+
+			logln("sign change bits image written to", *bitsImagePtr)
+		}
+
+		if *statsPtr {
+			printStats(result, decodeOpts)
+		}
+
+		logln("Success!")
+		logln()
+
+		for _, b := range result.Bytes {
+			fmt.Printf("%02X ", b)
+		}
+
+		fmt.Println()
+		logln()
+
+		if *annotatePtr {
+			printAnnotated(result.Bytes)
+		}
+
+		if *prgPtr != "" {
+			if err := writePRG(*prgPtr, result.Bytes, decodeOpts); err != nil {
+				fmt.Fprintln(os.Stderr, "problem writing program dump:", err)
+				os.Exit(1)
+			}
+
+			logln("program dump written to", *prgPtr)
+		}
+
+		if *sharePtr {
+			code, err := shareCode(result.Bytes)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "problem making share code:", err)
+				os.Exit(1)
+			}
+
+			fmt.Println(code)
+			logln()
+		}
+
+		if *verbosePtr {
+			if result.Strategy != "" {
+				fmt.Printf("Strategy: %s\n", result.Strategy)
+			}
+
+			if result.PrimedUpFront {
+				fmt.Println("The first buffer looked out of step, so it was dropped before decoding")
+			}
+
+			fmt.Printf("Frames Per Bit: %d\n", result.FramesPerBit)
+			fmt.Println()
+
+			timestamps := result.Timestamps()
+
+			for i := 0; i < len(timestamps) && i < len(result.Bytes); i++ {
+				fmt.Printf("Byte %d: %02X at %.3fs\n", i, result.Bytes[i], timestamps[i])
+			}
+
+			fmt.Println()
+		}
+
+		parseStart := time.Now()
+
+		sequence, err := decodeOpts.parseBytes(result.Bytes)
+		if err != nil {
+			if *allErrorsPtr {
+				if all := decodeOpts.validateAllBytes(result.Bytes); all != nil {
+					err = all
+				}
+			}
+
+			fmt.Fprintln(os.Stderr, "problem parsing bytes:", err)
+			os.Exit(1)
+		}
+
+		if err := decodeOpts.checkGateLengths(sequence); err != nil {
+			fmt.Fprintln(os.Stderr, "problem parsing bytes:", err)
+			os.Exit(1)
+		}
+
+		decodeOpts.profile.since(profileParse, parseStart)
+
+		if *verbosePtr {
+			fmt.Printf("Parsed the notes in %v, which verify skips\n", time.Since(parseStart).Round(time.Microsecond))
+			fmt.Println()
+		}
+
+		if decodeOpts.profile != nil {
+			decodeOpts.profile.print()
+		}
+
+		logln(sequence)
+
+		if *pitchesPtr {
+			printPitches(sequence, *interleavePtr)
+		}
+
+		if *musicXMLPtr != "" {
+			if err := writeMusicXML(*musicXMLPtr, sequence, *tempoPtr); err != nil {
+				fmt.Fprintln(os.Stderr, "problem writing MusicXML:", err)
+				os.Exit(1)
+			}
+
+			logln("MusicXML written to", *musicXMLPtr)
+		}
+
+		if *embedBytesPtr {
+			embedRawBytes(sequence, result.Bytes)
+		}
+
+		if *decodePtr && *jsonPtr {
+			if err := decodeOpts.writeJSON(name+".json", sequence); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			logln("json file written to", name+".json")
+		}
+	}
+}
+
+// decodeWavFile reads a wav file and decodes it into sign change bits and the
+// bytes they contain.
+func decodeWavFile(fileName string, opts decodeOptions) *DecodeResult {
+	waveFile, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer waveFile.Close()
+
+	decoder := wav.NewDecoder(waveFile)
+	if err := checkWavFile(decoder); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	warnSampleFormat(decoder, opts)
+	warnDataChunk(waveFile)
+
+	decoder.ReadMetadata()
+	if decoder.Metadata != nil {
+		printMetadata(decoder.Metadata)
+	}
+
+	result, err := generateWavBytes(context.Background(), decoder, opts)
+	if err != nil && opts.takes {
+		fmt.Fprintln(os.Stderr, err)
+		logln("the recording doesn't decode as a whole, decoding its takes one by one")
+
+		result, err = readTakes(context.Background(), decoder, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return result
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		var truncated *TruncatedError
+		if errors.As(err, &truncated) {
+			writePartial(strings.TrimSuffix(fileName, ".wav")+"_partial.json", truncated, opts)
+		} else {
+			warnSummedToMono(decoder, opts)
+		}
+
+		os.Exit(1)
+	}
+
+	if result.Strategy == invertedStrategyName {
+		logln("the recording's polarity looks to be inverted")
+	}
+
+	if result.Strategy == rightStrategyName {
+		logln("decoded from the right channel, the left didn't decode")
+	}
+
+	if expected := framesPerBitForRate(result.SampleRate); result.FramesPerBit != expected {
+		logf("decoded with %d frames per bit instead of %d\n", result.FramesPerBit, expected)
+	}
+
+	return result
+}
+
+// decodeBitsFile reads a file of sign change bits, byte-packed if packed is
+// set, and decodes the bytes they contain.
+func decodeBitsFile(fileName string, packed bool, framerate int, opts decodeOptions) *DecodeResult {
+	start := time.Now()
 
-		fmt.Println(sequence)
+	signBits, err := readBits(fileName, packed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "problem reading sign change bits:", err)
+		os.Exit(1)
+	}
 
-		if *decodePtr && *jsonPtr {
-			name := strings.TrimSuffix(*fileNamePtr, ".wav")
+	opts.profile.since(profileSignChange, start)
+	start = time.Now()
 
-			f, err := os.Create(name + ".json")
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-			defer f.Close()
+	framesPerBit := framesPerBitForRate(framerate)
 
-			prettyJSON, err := json.MarshalIndent(sequence, "", "    ")
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
+	bytes, offsets, falseMagicBytes, err := assembleBytesStats(context.Background(), newSignChangeDemodulator(signBits, framesPerBit), 0, opts)
 
-			_, err = f.Write(prettyJSON)
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
+	opts.profile.since(profileAssembly, start)
+	opts.profile.attempt(0, len(signBits), len(bytes))
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return &DecodeResult{SignBits: signBits, Bytes: bytes, Offsets: offsets, SampleRate: framerate, FramesPerBit: framesPerBit, FalseMagicBytes: falseMagicBytes}
+}
+
+// readBits reads sign change bits from a file. Unless packed is set, the file
+// is text with one 0 or 1 per line, as written by writeBits. A packed file has
+// eight bits per byte, most significant bit first. There's no telling the two
+// apart from the bytes alone, since a packed file can hold nothing but the
+// bytes of 0, 1 and whitespace.
+func readBits(fileName string, packed bool) ([]int, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var bits []int
+
+	if packed {
+		for _, b := range data {
+			for i := 7; i >= 0; i-- {
+				bits = append(bits, int(b>>i)&1)
 			}
+		}
+
+		return bits, nil
+	}
 
-			fmt.Println("json file written to", name+".json")
+	for _, field := range strings.Fields(string(data)) {
+		switch field {
+		case "0":
+			bits = append(bits, 0)
+		case "1":
+			bits = append(bits, 1)
+		default:
+			return nil, fmt.Errorf("invalid bit: %q, use -packed-bits for a byte-packed file", field)
 		}
 	}
+
+	return bits, nil
+}
+
+// writePRG writes a save's bytes to a file as a raw program dump, after
+// checking they validate with opts. There's no documented MC-202 memory
+// layout that differs from the order the bytes are saved to tape in, so the
+// dump is the tape bytes as they are, laid out as described on parseBytes,
+// without the data buffer, which is a tone rather than bytes.
+func writePRG(fileName string, data []byte, opts decodeOptions) error {
+	if _, err := opts.checkBytes(data); err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// writeJSON writes a sequence to a pretty printed JSON file in the options'
+// JSON style.
+func (o sequenceOptions) writeJSON(fileName string, sequence *Sequence) error {
+	prettyJSON, err := json.MarshalIndent(sequence, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if o.jsonStyle == jsonStyleGo {
+		prettyJSON = goFieldNames(prettyJSON)
+	}
+
+	return os.WriteFile(fileName, prettyJSON, 0644)
+}
+
+// writeWavStream creates a wav file and writes the audio generate produces to
+// it, as writeWavStreamTo does.
+func writeWavStream(fileName string, metadata *wav.Metadata, generate func(write func(samples []int) error) error) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeWavStreamTo(f, metadata, generate)
+}
+
+// writeWavStreamTo writes a 16 bit mono wav file to w, calling generate with a
+// function that appends samples to it, so the samples can be written as
+// they're generated instead of all being held in memory first.
+func writeWavStreamTo(w io.WriteSeeker, metadata *wav.Metadata, generate func(write func(samples []int) error) error) error {
+	enc := wav.NewEncoder(w, sampleRate, 16, 1, 1)
+	enc.Metadata = metadata
+
+	buf := &audio.IntBuffer{Format: &audio.Format{SampleRate: sampleRate, NumChannels: 1}}
+
+	err := generate(func(samples []int) error {
+		buf.Data = samples
+		return enc.Write(buf)
+	})
+	if err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// writeSequenceWav encodes a save's bytes straight to a wav file, writing the
+// audio as it's generated. If opts.verify is set the audio is decoded in
+// memory first instead, and only written if it decodes to the same bytes.
+func writeSequenceWav(fileName string, data []byte, opts encodeOptions, metadata *wav.Metadata) error {
+	if opts.verify {
+		return writeVerifiedWav(fileName, data, opts, metadata)
+	}
+
+	return writeWavStream(fileName, metadata, func(write func([]int) error) error {
+		return streamSequenceSamples(data, opts, write)
+	})
+}
+
+// verifyFile checks that a wav file decodes to bytes that pass validation and
+// returns the program number they're for.
+func verifyFile(fileName string, opts decodeOptions) (int, error) {
+	waveFile, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer waveFile.Close()
+
+	decoder := wav.NewDecoder(waveFile)
+	if err := checkWavFile(decoder); err != nil {
+		return 0, err
+	}
+
+	warnSampleFormat(decoder, opts)
+	warnDataChunk(waveFile)
+
+	result, err := generateWavBytes(context.Background(), decoder, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	return opts.checkBytes(result.Bytes)
+}
+
+// cleanFile decodes a wav file and, if the bytes validate, re-encodes them to
+// a fresh wav file with a full leader tone, reporting anything the decoder had
+// to do to recover the bytes.
+func cleanFile(fileName, outName string, decodeOpts decodeOptions, opts encodeOptions) {
+	waveFile, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer waveFile.Close()
+
+	decoder := wav.NewDecoder(waveFile)
+	if err := checkWavFile(decoder); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	warnSampleFormat(decoder, decodeOpts)
+	warnDataChunk(waveFile)
+
+	result, err := generateWavBytes(context.Background(), decoder, decodeOpts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if result.Strategy != decodeStrategies[0].name && result.Strategy != cueStrategyName {
+		logf("repair: decoded using the %s strategy\n", result.Strategy)
+	}
+
+	if err := decodeOpts.validateBytes(result.Bytes); err != nil {
+		fmt.Fprintln(os.Stderr, "problem validating bytes:", err)
+		os.Exit(1)
+	}
+
+	label := strings.TrimSuffix(path.Base(fileName), ".wav")
+
+	if err := writeSequenceWav(outName, result.Bytes, opts, sequenceMetadata(programNumber(result.Bytes), label)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logln("clean wav file written to", outName)
+}
+
+// sequenceMetadata returns the INFO chunk metadata written to encoded files:
+// the label as the title and the program number as the track number, so file
+// managers and players show something meaningful.
+func sequenceMetadata(programNumber int, label string) *wav.Metadata {
+	return &wav.Metadata{
+		Title:    infoString(label),
+		TrackNbr: infoString(fmt.Sprintf("%03d", programNumber)),
+		Comments: infoString(fmt.Sprintf("MC-202 program %03d", programNumber)),
+		Software: infoString("mc-202-librarian"),
+	}
+}
+
+// infoString pads an INFO chunk value so that its size, including the null
+// terminator, is even. The wav encoder doesn't add the padding byte RIFF
+// requires, which throws readers off for every entry after an odd-sized one.
+func infoString(s string) string {
+	if len(s)%2 == 0 {
+		return s + " "
+	}
+
+	return s
+}
+
+// printMetadata prints the INFO chunk metadata of a wav file, if any was found.
+func printMetadata(metadata *wav.Metadata) {
+	title := strings.TrimSpace(metadata.Title)
+	trackNbr := strings.TrimSpace(metadata.TrackNbr)
+
+	if title == "" && trackNbr == "" {
+		return
+	}
+
+	if title != "" {
+		logln("Label:", title)
+	}
+
+	if trackNbr != "" {
+		logln("Program Number (metadata):", trackNbr)
+	}
+
+	logln()
 }
 
 // generateSequenceFile takes a JSON file of the Sequence struct and generates the data
 // for a wav file based on the data in the struct.
-func generateSequenceFile(fileName string) []int {
-	f, err := os.Open(fileName)
+func generateSequenceFile(fileName string, channels int, opts encodeOptions) (*Sequence, []byte) {
+	sequence := readSequenceFile(fileName, opts)
+
+	data, err := opts.encodeSequence(sequence, channels)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return sequence, data
+}
+
+// readSequenceFile reads a JSON file of the Sequence struct.
+func readSequenceFile(fileName string, opts encodeOptions) *Sequence {
+	logln(fileName)
+
+	sequence, err := opts.loadSequence(fileName)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+
+	return sequence
+}
+
+// loadSequence reads a JSON file of the Sequence struct, checking its note
+// names and gate lengths as the options say to.
+func (o sequenceOptions) loadSequence(fileName string) (*Sequence, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 
-	fmt.Println(fileName)
+	var fields any
+
+	if err := json.NewDecoder(f).Decode(&fields); err != nil {
+		return nil, err
+	}
 
-	decoder := json.NewDecoder(f)
+	// files written before the fields were snake_case use the Go field names
+	data, err := json.Marshal(snakeFieldNames(fields))
+	if err != nil {
+		return nil, err
+	}
 
 	var sequence Sequence
 
-	err = decoder.Decode(&sequence)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if err := json.Unmarshal(data, &sequence); err != nil {
+		return nil, err
 	}
 
-	var result []int
+	if err := checkNoteNames(1, sequence.Channel1Notes, o.lenientParse); err != nil {
+		return nil, err
+	}
 
-	// generate 7 seconds of leader tone
-	result = append(result, generateSamples(oneFreq, 7*oneFreq, 0.25)...)
+	if err := checkNoteNames(2, sequence.Channel2Notes, o.lenientParse); err != nil {
+		return nil, err
+	}
 
-	result = append(result, generateByteSequence(magicByte, 0.25)...)
+	if err := o.checkGateLengths(&sequence); err != nil {
+		return nil, err
+	}
 
-	// program number
-	result = append(result, generateByteSequence(byte(sequence.ProgramNumber/100), 0.25)...)
-	result = append(result, generateByteSequence(byte(sequence.ProgramNumber%100/10), 0.25)...)
-	result = append(result, generateByteSequence(byte(sequence.ProgramNumber%10), 0.25)...)
+	return &sequence, nil
+}
 
-	// data buffer
-	result = append(result, generateSamples(oneFreq, dataBufferLength*oneCycles, 0.25)...)
+// checkNoteNames checks that every note in a channel that has a name agrees
+// with its note number, so a typo in a hand-written file is caught instead of
+// encoding whatever NoteNum was left at. If lenient, the note number is taken
+// from the name where there is one, clamped to the notes the MC-202 can play,
+// and the name and octave are rewritten to match.
+func checkNoteNames(channel int, notes []NoteLine, lenient bool) error {
+	for i := range notes {
+		note := &notes[i]
 
-	var channel1LineCount int
+		if note.Bar || note.NoteName == "" {
+			continue
+		}
 
-	for _, note := range sequence.Channel1Notes {
-		if note.Bar {
-			channel1LineCount++
-		} else {
-			channel1LineCount += 3
+		noteNum, err := ParseNote(note.NoteName, note.Octave)
+		if err == nil && noteNum != note.NoteNum {
+			err = fmt.Errorf("%w: %s%d is note %d, not %d", ErrNoteNameMismatch, note.NoteName, note.Octave, noteNum, note.NoteNum)
+		}
+
+		if err == nil {
+			continue
 		}
-	}
 
-	var channel1Checksum int16
+		if !lenient {
+			return fmt.Errorf("channel %d, line %d: %w", channel, i, err)
+		}
 
-	// insert channel 1 line count
-	result = append(result, generateByteSequence(byte(channel1LineCount/256), 0.25)...)
-	result = append(result, generateByteSequence(byte(channel1LineCount%256), 0.25)...)
+		if errors.Is(err, ErrInvalidNoteName) {
+			noteNum = note.NoteNum
+		}
 
-	channel1Checksum += int16(channel1LineCount / 256)
-	channel1Checksum += int16(channel1LineCount % 256)
+		noteNum = min(max(noteNum, MinNote), MaxNote)
 
-	for _, note := range sequence.Channel1Notes {
-		if note.Bar {
-			result = append(result, generateByteSequence(barByte, 0.25)...)
-			channel1Checksum += int16(barByte)
-		} else {
-			result = append(result, generateByteSequence(byte(note.StepLength), 0.25)...)
-			result = append(result, generateByteSequence(byte(note.GateLength), 0.25)...)
+		fmt.Fprintf(os.Stderr, "warning: channel %d, line %d: %v, using note %d\n", channel, i, err, noteNum)
+
+		note.NoteNum = noteNum
+		note.NoteName = noteMap[noteNum].NoteName
+		note.Octave = noteMap[noteNum].Octave
+	}
+
+	return nil
+}
+
+// The -gate-check modes: gates longer than their step are let through
+// silently, with a warning, or rejected.
+const (
+	gateCheckOff   = "off"
+	gateCheckWarn  = "warn"
+	gateCheckError = "error"
+)
 
-			var noteByte byte
+// checkGateLengths looks for notes whose gate length is longer than their
+// step length. The MC-202 holds a note for at most its step, so a longer gate
+// is more likely a misread byte than something that was keyed in, though it
+// can also be a tie. Depending on o.gateCheck each one is ignored, warned
+// about on stderr, or returned as a LineError.
+func (o sequenceOptions) checkGateLengths(sequence *Sequence) error {
+	if o.gateCheck == gateCheckOff {
+		return nil
+	}
 
-			if note.Portamento {
-				noteByte |= 0b10000000
+	for channel, notes := range [][]NoteLine{sequence.Channel1Notes, sequence.Channel2Notes} {
+		for i, note := range notes {
+			if note.Bar || note.GateLength <= note.StepLength {
+				continue
 			}
 
-			if note.Accent {
-				noteByte |= 0b01000000
+			err := &LineError{Err: ErrGateExceedsStep, Channel: channel + 1, Line: i, Value: note.GateLength}
+
+			if o.gateCheck == gateCheckError {
+				return err
 			}
 
-			noteByte |= byte(note.NoteNum)
+			fmt.Fprintf(os.Stderr, "warning: %v, step length %d\n", err, note.StepLength)
+		}
+	}
+
+	return nil
+}
+
+// printLayout prints the bytes that would be written to tape followed by a
+// summary of the line counts and checksums, and how long the wav file would
+// be with opts.
+func printLayout(data []byte, opts encodeOptions) error {
+	for _, b := range data {
+		fmt.Printf("%02X ", b)
+	}
+
+	fmt.Println()
+	fmt.Println()
 
-			result = append(result, generateByteSequence(noteByte, 0.25)...)
+	sequence, err := opts.parseBytes(data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Bytes: %d\n", len(data))
+	fmt.Printf("Program Number: %d\n", sequence.ProgramNumber)
+	fmt.Printf("Number of Channels: %d\n", sequence.NumChannels)
+	fmt.Printf("Channel 1 Line Count: %d\n", sequence.Channel1LineCount)
+	fmt.Printf("Channel 1 Checksum Byte Hex: %02X\n", sequence.Channel1ChecksumByte)
+	fmt.Printf("Channel 2 Line Count: %d\n", sequence.Channel2LineCount)
+	fmt.Printf("Channel 2 Adjusted Line Count: %d\n", sequence.Channel2AdjustedLineCount)
+	fmt.Printf("Channel 2 Checksum Byte Hex: %02X\n", sequence.Channel2ChecksumByte)
+	fmt.Printf("Duration: %.2fs\n", encodedDuration(len(data), sampleRate, leaderSeconds, trailerSeconds, opts))
+
+	return nil
+}
+
+// encodeSequence converts a Sequence into the bytes the MC-202 expects on tape,
+// including the line counts and checksums for each channel.
+//
+// channels selects the layout: 1 writes a single-channel save where channel 2
+// is empty and its line count repeats channel 1's, 2 writes both channels and
+// requires channel 2 to have notes. 0 uses whatever the sequence contains.
+func encodeSequence(sequence *Sequence, channels int) ([]byte, error) {
+	return defaultSequenceOptions.encodeSequence(sequence, channels)
+}
 
-			channel1Checksum += int16(note.StepLength)
-			channel1Checksum += int16(note.GateLength)
-			channel1Checksum += int16(noteByte)
+// encodeSequence is encodeSequence with the line count limit of the options.
+func (o sequenceOptions) encodeSequence(sequence *Sequence, channels int) ([]byte, error) {
+	channel2Notes := sequence.Channel2Notes
+
+	switch channels {
+	case 0:
+	case 1:
+		if len(channel2Notes) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: encoding a single channel, ignoring %d channel 2 notes\n", len(channel2Notes))
+		}
+		channel2Notes = nil
+	case 2:
+		if len(channel2Notes) == 0 {
+			return nil, fmt.Errorf("%w: cannot encode two channels, channel 2 has no notes", ErrInvalidChannels)
 		}
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrInvalidChannels, channels)
+	}
+
+	if sequence.ProgramNumber < 0 || sequence.ProgramNumber > 999 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidProgramNumber, sequence.ProgramNumber)
+	}
+
+	if err := checkNoteLines(1, sequence.Channel1Notes); err != nil {
+		return nil, err
+	}
+
+	if err := checkNoteLines(2, channel2Notes); err != nil {
+		return nil, err
+	}
+
+	channel1LineCount := lineCount(sequence.Channel1Notes)
+
+	// channel 2 line count is the running total of both channels, so a
+	// single-channel save repeats channel 1's line count here
+	channel2LineCount := channel1LineCount + lineCount(channel2Notes)
+
+	// a line count has two bytes, and one the validator would reject
+	// couldn't be decoded again
+	maxLineCount := min(o.maxLineCount, math.MaxUint16)
+
+	if channel1LineCount > maxLineCount {
+		return nil, fmt.Errorf("%w, channel 1: %d lines, the most is %d", ErrInvalidLineCount, channel1LineCount, maxLineCount)
+	}
+
+	if channel2LineCount > maxLineCount {
+		return nil, fmt.Errorf("%w, channel 2: total %d lines, the most is %d", ErrInvalidLineCount, channel2LineCount, maxLineCount)
+	}
+
+	data := []byte{
+		magicByte,
+		byte(sequence.ProgramNumber / 100),
+		byte(sequence.ProgramNumber % 100 / 10),
+		byte(sequence.ProgramNumber % 10),
 	}
 
-	channel1ChecksumByte := byte(channel1Checksum)
+	// channel 1 line count, notes and checksum
+	data = appendChannel(data, channel1LineCount, sequence.Channel1Notes)
+
+	data = appendChannel(data, channel2LineCount, channel2Notes)
+
+	return data, nil
+}
+
+// checkNoteLines checks that every note in a channel is within the limits
+// the MC-202 can store.
+func checkNoteLines(channel int, notes []NoteLine) error {
+	for i, note := range notes {
+		if note.Bar {
+			continue
+		}
+
+		if note.StepLength < MinStepLength || note.StepLength > MaxStepLength {
+			return fmt.Errorf("%w, channel %d, note %d: %d", ErrStepOutOfRange, channel, i, note.StepLength)
+		}
+
+		if note.GateLength < MinGateLength || note.GateLength > MaxGateLength {
+			return fmt.Errorf("%w, channel %d, note %d: %d", ErrGateOutOfRange, channel, i, note.GateLength)
+		}
 
-	// convert to two's complement
-	channel1ChecksumByte = ^channel1ChecksumByte
-	channel1ChecksumByte++
+		if note.NoteNum < MinNote || note.NoteNum > MaxNote {
+			return fmt.Errorf("%w, channel %d, note %d: %d", ErrNoteOutOfRange, channel, i, note.NoteNum)
+		}
+	}
 
-	// insert channel 1 checksum
-	result = append(result, generateByteSequence(channel1ChecksumByte, 0.25)...)
+	return nil
+}
 
-	channel2LineCount := channel1LineCount
+// lineCount returns the number of lines the notes occupy on tape. A bar is a
+// single line, every other note is three lines (step, gate and note).
+func lineCount(notes []NoteLine) int {
+	var count int
 
-	for _, note := range sequence.Channel2Notes {
+	for _, note := range notes {
 		if note.Bar {
-			channel2LineCount++
+			count++
 		} else {
-			channel2LineCount += 3
+			count += 3
 		}
 	}
 
-	var channel2Checksum int16
+	return count
+}
+
+// encodeNoteByte returns the note byte for a note: the note number in the low
+// six bits, with accent and portamento set in the two above, the reverse of
+// how parseBytes reads it.
+func encodeNoteByte(note NoteLine) byte {
+	noteByte := byte(note.NoteNum) & noteNumMask
+
+	if note.Portamento {
+		noteByte |= portamentoMask
+	}
+
+	if note.Accent {
+		noteByte |= accentMask
+	}
 
-	// insert channel 2 line count
-	result = append(result, generateByteSequence(byte(channel2LineCount/256), 0.25)...)
-	result = append(result, generateByteSequence(byte(channel2LineCount%256), 0.25)...)
+	return noteByte
+}
 
-	channel2Checksum += int16(channel2LineCount / 256)
+// appendChannel appends a channel's line count, note lines and checksum byte
+// to data.
+func appendChannel(data []byte, lineCount int, notes []NoteLine) []byte {
+	start := len(data)
 
-	channel2Checksum += int16(channel2LineCount % 256)
+	data = appendLineCount(data, lineCount)
 
-	for _, note := range sequence.Channel2Notes {
+	for _, note := range notes {
 		if note.Bar {
-			result = append(result, generateByteSequence(barByte, 0.25)...)
-			channel2Checksum += int16(barByte)
-		} else {
-			result = append(result, generateByteSequence(byte(note.StepLength), 0.25)...)
-			result = append(result, generateByteSequence(byte(note.GateLength), 0.25)...)
+			data = append(data, barByte)
+			continue
+		}
 
-			var noteByte byte
+		data = append(data, byte(note.StepLength), byte(note.GateLength), encodeNoteByte(note))
+	}
 
-			if note.Portamento {
-				noteByte |= 0b10000000
-			}
+	return append(data, checksum(data[start:]))
+}
 
-			if note.Accent {
-				noteByte |= 0b01000000
-			}
+// encodeOptions controls how encoded bytes are turned into audio.
+type encodeOptions struct {
+	// leaderAmplitude is the amplitude of the leader and trailing tones and
+	// dataAmplitude that of the bytes and the data buffer, as fractions of
+	// full scale. Some decks record more reliably with the leader hotter or
+	// quieter than the data.
+	leaderAmplitude float64
+	dataAmplitude   float64
+	// stopCycles is the number of one-frequency cycles of stop bits after
+	// each byte. The MC-202 writes two stop bits, oneCycles*2 cycles, and the
+	// decoder needs both to accept a byte.
+	stopCycles int
+	// gapCycles is the number of extra one-frequency cycles between bytes.
+	// On tape they're indistinguishable from longer stop bits.
+	gapCycles int
+	// leaderRamp is how long the leader tone takes to fade in from silence,
+	// for decks whose heads or AGC don't take a sudden tone well.
+	leaderRamp time.Duration
+	// verify decodes the audio in memory before it's written and fails if
+	// it doesn't decode to the bytes it was encoded from.
+	verify bool
+
+	sequenceOptions
+}
+
+// maxLeaderRamp is the longest the leader tone can take to fade in. It leaves
+// five of the leader's seven seconds at full amplitude, which is plenty for
+// the MC-202 and the decoder to lock on to.
+const maxLeaderRamp = 2 * time.Second
+
+// defaultAmplitude is the amplitude of both the tones and the data unless
+// -leader-amp or -data-amp say otherwise.
+const defaultAmplitude = 0.25
+
+var defaultEncodeOptions = encodeOptions{
+	leaderAmplitude: defaultAmplitude,
+	dataAmplitude:   defaultAmplitude,
+	stopCycles:      oneCycles * 2,
+	sequenceOptions: defaultSequenceOptions,
+}
+
+// rampIn fades in the first n samples linearly from silence.
+func rampIn(samples []int, n int) {
+	if n > len(samples) {
+		n = len(samples)
+	}
+
+	for i := 0; i < n; i++ {
+		samples[i] = samples[i] * i / n
+	}
+}
+
+// generateDataBuffer generates the data buffer the MC-202 writes between the
+// program number and the line counts: dataBufferLength bit periods of one
+// bits, oneCycles cycles of the one frequency each, with nothing to mark where
+// the bits start or end. It follows straight on from the stop bits of the
+// last program number digit, and the start bit of the channel 1 line count
+// follows straight on from it.
+//
+// The buffer carries no data, so a buffer that decoded marginally can be
+// rebuilt by re-encoding the decoded bytes, which is what the clean subcommand
+// does.
+// assembleBytes checks every one of its bit periods reads as a one bit.
+func generateDataBuffer(amplitude float64) []int {
+	return generateSamples(oneFreq, dataBufferLength*oneCycles, amplitude)
+}
 
-			noteByte |= byte(note.NoteNum)
+// streamSequenceSamples generates the audio for a complete tape save from the
+// encoded bytes: the leader tone, the magic byte and program number, the data
+// buffer, the channel data and the trailing tone. The audio is passed to write
+// a section or a byte at a time as it's generated, so a long tape is never
+// held in memory, and it stops at the first error write returns.
+func streamSequenceSamples(data []byte, opts encodeOptions, write func(samples []int) error) error {
+	amplitude := opts.dataAmplitude
+
+	// generate 7 seconds of leader tone
+	leader := generateSamples(oneFreq, leaderSeconds*oneFreq, opts.leaderAmplitude)
+	rampIn(leader, int(opts.leaderRamp.Seconds()*sampleRate))
+
+	if err := write(leader); err != nil {
+		return err
+	}
 
-			result = append(result, generateByteSequence(noteByte, 0.25)...)
-			channel2Checksum += int16(note.StepLength)
-			channel2Checksum += int16(note.GateLength)
-			channel2Checksum += int16(noteByte)
+	// magic byte and program number
+	for _, b := range data[:4] {
+		if err := write(generateByteSamples(b, amplitude, opts.stopCycles+opts.gapCycles)); err != nil {
+			return err
 		}
 	}
 
-	channel2ChecksumByte := byte(channel2Checksum)
+	if err := write(generateDataBuffer(amplitude)); err != nil {
+		return err
+	}
 
-	// convert to two's complement
-	channel2ChecksumByte = ^channel2ChecksumByte
-	channel2ChecksumByte++
+	for _, b := range data[4 : len(data)-1] {
+		if err := write(generateByteSamples(b, amplitude, opts.stopCycles+opts.gapCycles)); err != nil {
+			return err
+		}
+	}
 
-	// insert channel 2 checksum
-	result = append(result, generateLastByte(channel2ChecksumByte, 0.25)...)
+	// the channel 2 checksum is the last byte and has no stop bits
+	if err := write(generateLastByte(data[len(data)-1], amplitude)); err != nil {
+		return err
+	}
 
 	// generate 1 second of leader tone
-	result = append(result, generateSamples(zeroFreq, zeroFreq, 0.25)...)
-
-	return result
+	return write(generateSamples(zeroFreq, trailerSeconds*zeroFreq, opts.leaderAmplitude))
 }
 
 func generateEmptySequence(amplitude float64) []int {
@@ -937,8 +3267,7 @@ func generateEmptySequence(amplitude float64) []int {
 	result = append(result, generateByteSequence(byte(2), amplitude)...)
 	result = append(result, generateByteSequence(byte(3), amplitude)...)
 
-	// data buffer
-	result = append(result, generateSamples(oneFreq, dataBufferLength*oneCycles, amplitude)...)
+	result = append(result, generateDataBuffer(amplitude)...)
 
 	// total lines
 	result = append(result, generateByteSequence(byte(0x0), amplitude)...)
@@ -1000,6 +3329,12 @@ func generateLastByte(b byte, amplitude float64) []int {
 }
 
 func generateByteSequence(b byte, amplitude float64) []int {
+	return generateByteSamples(b, amplitude, oneCycles*2)
+}
+
+// generateByteSamples generates a start bit, the eight data bits, least
+// significant first, and stopCycles cycles of the one frequency.
+func generateByteSamples(b byte, amplitude float64, stopCycles int) []int {
 	var result []int
 
 	result = append(result, generateSamples(zeroFreq, zeroCycles, amplitude)...)
@@ -1013,7 +3348,7 @@ func generateByteSequence(b byte, amplitude float64) []int {
 	}
 
 	// stop bits
-	result = append(result, generateSamples(oneFreq, oneCycles*2, amplitude)...)
+	result = append(result, generateSamples(oneFreq, stopCycles, amplitude)...)
 
 	return result
 }
@@ -0,0 +1,2291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+)
+
+// note returns a note line for noteNum with the given step and gate lengths.
+func note(noteNum, step, gate int) NoteLine {
+	return NoteLine{
+		NoteNum:    noteNum,
+		NoteName:   noteMap[noteNum].NoteName,
+		Octave:     noteMap[noteNum].Octave,
+		StepLength: step,
+		GateLength: gate,
+	}
+}
+
+// bar returns a bar line.
+func bar() NoteLine {
+	return NoteLine{Bar: true}
+}
+
+// bars returns n bar lines.
+func bars(n int) []NoteLine {
+	lines := make([]NoteLine, n)
+	for i := range lines {
+		lines[i] = bar()
+	}
+
+	return lines
+}
+
+// encodeWav encodes a save's bytes to a wav file in memory.
+func encodeWav(t testing.TB, data []byte, opts encodeOptions) []byte {
+	t.Helper()
+
+	var wavFile memFile
+
+	err := writeWavStreamTo(&wavFile, nil, func(write func([]int) error) error {
+		return streamSequenceSamples(data, opts, write)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wavFile.data
+}
+
+func TestEncodeSequenceChannels(t *testing.T) {
+	twoChannels := &Sequence{
+		Header:        Header{ProgramNumber: 42},
+		Channel1Notes: []NoteLine{note(12, 6, 3), bar()},
+		Channel2Notes: []NoteLine{note(24, 12, 6)},
+	}
+
+	tests := []struct {
+		name         string
+		sequence     *Sequence
+		channels     int
+		numChannels  int
+		channel2Note bool
+	}{
+		{"both channels", twoChannels, 0, 2, true},
+		{"two channels", twoChannels, 2, 2, true},
+		{"single channel", twoChannels, 1, 1, false},
+		{"only channel 2", &Sequence{Channel2Notes: []NoteLine{note(0, 6, 6)}}, 0, 2, true},
+		{"empty", &Sequence{}, 1, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeSequence(tt.sequence, tt.channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := Decode(bytes.NewReader(encodeWav(t, data, defaultEncodeOptions)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decoded.NumChannels != tt.numChannels {
+				t.Errorf("NumChannels = %d, want %d", decoded.NumChannels, tt.numChannels)
+			}
+
+			if got := len(decoded.Channel2Notes) > 0; got != tt.channel2Note {
+				t.Errorf("channel 2 has notes = %t, want %t", got, tt.channel2Note)
+			}
+
+			if decoded.Channel2LineCount < decoded.Channel1LineCount {
+				t.Errorf("total line count %d is less than channel 1's %d", decoded.Channel2LineCount, decoded.Channel1LineCount)
+			}
+		})
+	}
+}
+
+func TestEncodeSequenceInvalidChannels(t *testing.T) {
+	for _, channels := range []int{-1, 3} {
+		if _, err := encodeSequence(&Sequence{}, channels); !errors.Is(err, ErrInvalidChannels) {
+			t.Errorf("channels %d: err = %v, want ErrInvalidChannels", channels, err)
+		}
+	}
+
+	if _, err := encodeSequence(&Sequence{Channel1Notes: []NoteLine{bar()}}, 2); !errors.Is(err, ErrInvalidChannels) {
+		t.Errorf("two channels with channel 2 empty: err = %v, want ErrInvalidChannels", err)
+	}
+}
+
+func TestEncodeSequenceLineCountLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence *Sequence
+		ok       bool
+	}{
+		{"at the limit", &Sequence{Channel1Notes: bars(DefaultMaxLineCount)}, true},
+		{"channel 1 too long", &Sequence{Channel1Notes: bars(DefaultMaxLineCount + 1)}, false},
+		{"total too long", &Sequence{Channel1Notes: bars(DefaultMaxLineCount / 2), Channel2Notes: bars(DefaultMaxLineCount/2 + 1)}, false},
+		// a count that wraps around in two bytes would look short and valid
+		{"wraps two bytes", &Sequence{Channel1Notes: bars(0x10000 + 1)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeSequence(tt.sequence, 0)
+
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := validateBytes(data); err != nil {
+					t.Errorf("encoded bytes don't validate: %v", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidLineCount) {
+				t.Errorf("err = %v, want ErrInvalidLineCount", err)
+			}
+
+			if data != nil {
+				t.Errorf("wrote %d bytes for a sequence that's too long", len(data))
+			}
+		})
+	}
+}
+
+// wavBytes writes 16 bit samples, interleaved if there's more than one
+// channel, to a wav file in memory.
+func wavBytes(t testing.TB, rate, channels int, samples []int) []byte {
+	t.Helper()
+
+	var wavFile memFile
+
+	enc := wav.NewEncoder(&wavFile, rate, 16, channels, 1)
+
+	if len(samples) > 0 {
+		buf := &audio.IntBuffer{Data: samples, Format: &audio.Format{SampleRate: rate, NumChannels: channels}}
+		if err := enc.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return wavFile.data
+}
+
+// sequenceSamples returns the samples a save's bytes encode to.
+func sequenceSamples(t testing.TB, data []byte) []int {
+	t.Helper()
+
+	var samples []int
+
+	err := streamSequenceSamples(data, defaultEncodeOptions, func(s []int) error {
+		samples = append(samples, s...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return samples
+}
+
+// sampleFloats returns 16 bit samples scaled to between -1 and 1.
+func sampleFloats(samples []int) []float64 {
+	floats := make([]float64, len(samples))
+	for i, sample := range samples {
+		floats[i] = float64(sample) / 0x7FFF
+	}
+
+	return floats
+}
+
+// sampleBits returns the sign change bits of 16 bit samples.
+func sampleBits(samples []int) []int {
+	return signChangeBits(sampleFloats(samples), 0, false)
+}
+
+// addNoise returns a copy of 16 bit samples with uniform noise of up to noise
+// either way added to each.
+func addNoise(samples []int, noise int, rng *rand.Rand) []int {
+	noisy := slices.Clone(samples)
+	for i := range noisy {
+		noisy[i] = max(-0x7FFF, min(0x7FFF, noisy[i]+rng.Intn(2*noise+1)-noise))
+	}
+
+	return noisy
+}
+
+// saveBytes lays out a save with the given line counts and lines, working out
+// the checksums, so a test can build one that's wrong in only one way.
+func saveBytes(program int, channel1Count int, channel1 []byte, totalCount int, channel2 []byte) []byte {
+	data := []byte{magicByte, byte(program / 100), byte(program % 100 / 10), byte(program % 10)}
+
+	start := len(data)
+	data = appendLineCount(data, channel1Count)
+	data = append(data, channel1...)
+	data = append(data, checksum(data[start:]))
+
+	start = len(data)
+	data = appendLineCount(data, totalCount)
+	data = append(data, channel2...)
+
+	return append(data, checksum(data[start:]))
+}
+
+// testSequence is a two channel sequence with notes, bars, accents and
+// portamento in it.
+func testSequence() *Sequence {
+	accented := note(MaxNote, 24, 12)
+	accented.Accent = true
+	accented.Portamento = true
+
+	return &Sequence{
+		Header:        Header{ProgramNumber: 207, NumChannels: 2},
+		Channel1Notes: []NoteLine{note(12, 6, 3), bar(), note(MinNote, 12, 12), accented},
+		Channel2Notes: []NoteLine{bar(), note(36, 6, 6), bar()},
+	}
+}
+
+// emptySequenceBytes are the bytes of the save generateEmptySequence writes.
+var emptySequenceBytes = []byte{
+	0xE0, 0x01, 0x02, 0x03,
+	0x00, 0x0F,
+	0x18, 0x0C, 0x1A,
+	0x18, 0x0C, 0x19,
+	0x18, 0x0C, 0x1E,
+	0x18, 0x0C, 0x1F,
+	0x18, 0x0C, 0x28,
+	0xA5,
+	0x00, 0x0F,
+	0xF1,
+}
+
+func TestParseBytes(t *testing.T) {
+	// the empty sequence with its last note byte replaced and the checksum
+	// fixed up to match
+	withNoteByte := func(b byte) []byte {
+		data := slices.Clone(emptySequenceBytes)
+		data[20] = b
+		data[21] = checksum(data[4:21])
+		return data
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		err         error
+		numChannels int
+		notes       [2]int
+	}{
+		{name: "empty sequence", data: emptySequenceBytes, numChannels: 1, notes: [2]int{5, 0}},
+		{name: "highest note with accent and portamento", data: withNoteByte(0xFC), numChannels: 1, notes: [2]int{5, 0}},
+		// 61 fits in the six bits of the note number but isn't a note
+		{name: "note byte 0x3D", data: withNoteByte(0x3D), err: ErrNoteOutOfRange},
+		{name: "note byte 0x3F with accent", data: withNoteByte(0x7F), err: ErrNoteOutOfRange},
+		{name: "too few bytes", data: emptySequenceBytes[:9], err: ErrTooFewBytes},
+		{name: "invalid magic byte", data: append([]byte{0xE1}, emptySequenceBytes[1:]...), err: ErrInvalidMagicByte},
+		{name: "program digit over 9", data: saveBytes(0, 0, nil, 0, nil)[:1:1], err: ErrTooFewBytes},
+		{
+			name: "channel 1 checksum",
+			data: func() []byte {
+				data := slices.Clone(emptySequenceBytes)
+				data[21]++
+				return data
+			}(),
+			err: ErrChecksumMismatch,
+		},
+		{
+			name: "channel 2 checksum",
+			data: func() []byte {
+				data := slices.Clone(emptySequenceBytes)
+				data[24]++
+				return data
+			}(),
+			err: ErrChecksumMismatch,
+		},
+		// a note that starts one line before the end of the channel, so
+		// its gate and note byte would be read from past the line count
+		{name: "off by one", data: saveBytes(1, 5, []byte{0xFF, 0x18, 0x0C, 0x1A, 0x18}, 5, nil), err: ErrLineCountMismatch},
+		{name: "bars only", data: saveBytes(1, 2, []byte{0xFF, 0xFF}, 3, []byte{0xFF}), numChannels: 2, notes: [2]int{0, 0}},
+		{name: "two channels", data: saveBytes(999, 4, []byte{0x18, 0x0C, 0x1A, 0xFF}, 7, []byte{0x06, 0x06, 0x00}), numChannels: 2, notes: [2]int{1, 1}},
+		// nothing can be keyed in with a step of 0, but it fits on tape
+		{name: "step of 0", data: saveBytes(1, 3, []byte{0x00, 0x00, 0x1A}, 3, nil), numChannels: 1, notes: [2]int{1, 0}},
+		{name: "empty channel 1", data: saveBytes(5, 0, nil, 3, []byte{0x18, 0x0C, 0x1A}), numChannels: 2, notes: [2]int{0, 1}},
+		{name: "total less than channel 1", data: saveBytes(5, 3, []byte{0x18, 0x0C, 0x1A}, 0, nil), err: ErrInvalidLineCount},
+		{name: "line count too high", data: saveBytes(5, DefaultMaxLineCount+1, bytes.Repeat([]byte{barByte}, DefaultMaxLineCount+1), DefaultMaxLineCount+1, nil), err: ErrInvalidLineCount},
+	}
+
+	// a program number digit over 9
+	badProgram := slices.Clone(emptySequenceBytes)
+	badProgram[2] = 10
+	tests[6].data, tests[6].err = badProgram, ErrInvalidProgramNumber
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sequence, err := parseBytes(tt.data)
+
+			if validateErr := validateBytes(tt.data); (validateErr == nil) != (err == nil) {
+				t.Errorf("validateBytes returned %v, but parseBytes %v", validateErr, err)
+			}
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sequence.NumChannels != tt.numChannels {
+				t.Errorf("NumChannels = %d, want %d", sequence.NumChannels, tt.numChannels)
+			}
+
+			ch1Notes, _, ch2Notes, _ := sequence.Counts()
+			if ch1Notes != tt.notes[0] || ch2Notes != tt.notes[1] {
+				t.Errorf("notes = %d and %d, want %d and %d", ch1Notes, ch2Notes, tt.notes[0], tt.notes[1])
+			}
+		})
+	}
+}
+
+func TestParseBytesNoteOutOfRangeLine(t *testing.T) {
+	data := saveBytes(1, 4, []byte{0xFF, 0x18, 0x0C, 0x3D}, 4, nil)
+
+	_, err := parseBytes(data)
+
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) {
+		t.Fatalf("err = %v, want a LineError", err)
+	}
+
+	if lineErr.Channel != 1 || lineErr.Line != 3 || lineErr.Value != 61 {
+		t.Errorf("got channel %d, line %d, value %d, want channel 1, line 3, value 61", lineErr.Channel, lineErr.Line, lineErr.Value)
+	}
+}
+
+func TestChecksumErrorProgramNumber(t *testing.T) {
+	data := saveBytes(123, 3, []byte{0x18, 0x0C, 0x1A}, 3, nil)
+	data[len(data)-1]++
+
+	var checksumErr *ChecksumError
+	if err := validateBytes(data); !errors.As(err, &checksumErr) {
+		t.Fatalf("err = %v, want a ChecksumError", err)
+	}
+
+	if checksumErr.Channel != 2 || checksumErr.ProgramNumber != 123 {
+		t.Errorf("got channel %d, program %d, want channel 2, program 123", checksumErr.Channel, checksumErr.ProgramNumber)
+	}
+}
+
+func TestChecksumsMatchStoredBytes(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequence, err := parseBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := checksumByte(int8(sequence.Channel1Checksum)); sequence.Channel1ChecksumByte != want {
+		t.Errorf("channel 1 checksum byte = %02X, want %02X", sequence.Channel1ChecksumByte, want)
+	}
+
+	// the channel 2 checksum byte is the last byte of the save
+	if sequence.Channel2ChecksumByte != data[len(data)-1] {
+		t.Errorf("channel 2 checksum byte = %02X, want the last byte, %02X", sequence.Channel2ChecksumByte, data[len(data)-1])
+	}
+
+	if want := checksumByte(int8(sequence.Channel2Checksum)); sequence.Channel2ChecksumByte != want {
+		t.Errorf("channel 2 checksum byte = %02X, want %02X", sequence.Channel2ChecksumByte, want)
+	}
+}
+
+func TestChecksumByte(t *testing.T) {
+	tests := []struct {
+		sum  int8
+		want byte
+	}{
+		{0, 0x00},
+		{1, 0xFF},
+		{-1, 0x01},
+		{127, 0x81},
+		// -128 is its own two's complement
+		{-128, 0x80},
+		{-15, 0x0F},
+	}
+
+	for _, tt := range tests {
+		if got := checksumByte(tt.sum); got != tt.want {
+			t.Errorf("checksumByte(%d) = %02X, want %02X", tt.sum, got, tt.want)
+		}
+	}
+
+	for sum := math.MinInt8; sum <= math.MaxInt8; sum++ {
+		if total := int8(sum) + int8(checksumByte(int8(sum))); total != 0 {
+			t.Errorf("checksumByte(%d) leaves a total of %d", sum, total)
+		}
+	}
+}
+
+func TestChecksumWraparound(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want byte
+	}{
+		{nil, 0x00},
+		// 0x80 + 0x80 wraps around to zero
+		{[]byte{0x80, 0x80}, 0x00},
+		// 127 + 1 wraps around to -128
+		{[]byte{0x7F, 0x01}, 0x80},
+		{[]byte{0xFF, 0xFF, 0xFF}, 0x03},
+		{emptySequenceBytes[4:21], 0xA5},
+	}
+
+	for _, tt := range tests {
+		if got := checksum(tt.data); got != tt.want {
+			t.Errorf("checksum(% X) = %02X, want %02X", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeNoteByte(t *testing.T) {
+	for noteNum := MinNote; noteNum <= MaxNote; noteNum++ {
+		for _, accent := range []bool{false, true} {
+			for _, portamento := range []bool{false, true} {
+				line := note(noteNum, 6, 6)
+				line.Accent = accent
+				line.Portamento = portamento
+
+				b := encodeNoteByte(line)
+
+				if int(b&noteNumMask) != noteNum || (b&accentMask != 0) != accent || (b&portamentoMask != 0) != portamento {
+					t.Errorf("encodeNoteByte(%d, accent %t, portamento %t) = %08b", noteNum, accent, portamento, b)
+				}
+			}
+		}
+	}
+
+	// the highest note with both flags set, round tripped through the
+	// parser
+	line := note(MaxNote, 6, 6)
+	line.Accent = true
+	line.Portamento = true
+
+	if b := encodeNoteByte(line); b != 0b11111100 {
+		t.Errorf("encodeNoteByte = %08b, want 11111100", b)
+	}
+
+	data, err := encodeSequence(&Sequence{Channel1Notes: []NoteLine{line}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequence, err := parseBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sequence.Channel1Notes[0].Equal(line) {
+		t.Errorf("round tripped to %+v, want %+v", sequence.Channel1Notes[0], line)
+	}
+}
+
+func TestEncodeParseRoundTrip(t *testing.T) {
+	longest := note(30, MaxStepLength, MaxGateLength)
+
+	tests := []struct {
+		name     string
+		sequence *Sequence
+	}{
+		{"empty", &Sequence{Header: Header{NumChannels: 1}}},
+		{"one note", &Sequence{Header: Header{NumChannels: 1}, Channel1Notes: []NoteLine{note(0, 6, 6)}}},
+		{"bars only", &Sequence{Header: Header{NumChannels: 1}, Channel1Notes: []NoteLine{bar(), bar()}}},
+		{"two channels", testSequence()},
+		{"only channel 2", &Sequence{Header: Header{ProgramNumber: 1, NumChannels: 2}, Channel2Notes: []NoteLine{note(60, 6, 3), bar()}}},
+		{"shortest step and gate", &Sequence{Header: Header{NumChannels: 1}, Channel1Notes: []NoteLine{note(30, MinStepLength, MinGateLength)}}},
+		{"longest step and gate", &Sequence{Header: Header{NumChannels: 1}, Channel1Notes: []NoteLine{longest}}},
+		{"program 999", &Sequence{Header: Header{ProgramNumber: 999, NumChannels: 1}, Channel1Notes: []NoteLine{note(1, 1, 0)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeSequence(tt.sequence, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sequence, err := parseBytes(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !sequence.Equal(tt.sequence) {
+				t.Errorf("round tripped to\n%v\nwant\n%v", sequence, tt.sequence)
+			}
+
+			reencoded, err := encodeSequence(sequence, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(reencoded, data) {
+				t.Errorf("re-encoded to % X, want % X", reencoded, data)
+			}
+		})
+	}
+}
+
+func TestLineCountByteOrder(t *testing.T) {
+	// 300 lines are 01 2C big endian, which read little endian would be
+	// 11265, more than the validator allows
+	bars := bytes.Repeat([]byte{barByte}, 300)
+	data := saveBytes(1, 300, bars, 300, nil)
+
+	if data[4] != 0x01 || data[5] != 0x2C {
+		t.Fatalf("line count written as % X, want 01 2C", data[4:6])
+	}
+
+	if got := lineCountAt(data, 4); got != 300 {
+		t.Errorf("lineCountAt = %d, want 300", got)
+	}
+
+	sequence, err := parseBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sequence.Channel1LineCount != 300 || len(sequence.Channel1Notes) != 300 {
+		t.Errorf("got %d lines and %d bars, want 300", sequence.Channel1LineCount, len(sequence.Channel1Notes))
+	}
+}
+
+func TestCounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence *Sequence
+		want     [4]int
+	}{
+		{"empty", &Sequence{}, [4]int{}},
+		{"test sequence", testSequence(), [4]int{3, 1, 1, 2}},
+		{"bars only", &Sequence{Channel2Notes: []NoteLine{bar(), bar(), bar()}}, [4]int{0, 0, 0, 3}},
+	}
+
+	for _, tt := range tests {
+		ch1Notes, ch1Bars, ch2Notes, ch2Bars := tt.sequence.Counts()
+
+		if got := [4]int{ch1Notes, ch1Bars, ch2Notes, ch2Bars}; got != tt.want {
+			t.Errorf("%s: Counts() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	sequence, err := parseBytes(emptySequenceBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ch1Notes, ch1Bars, _, _ := sequence.Counts(); ch1Notes != 5 || ch1Bars != 0 || sequence.Channel1LineCount != 15 {
+		t.Errorf("empty sequence: %d notes and %d bars in %d lines, want 5 notes in 15 lines", ch1Notes, ch1Bars, sequence.Channel1LineCount)
+	}
+}
+
+func TestSequenceClone(t *testing.T) {
+	original := testSequence()
+	clone := original.Clone()
+
+	if !clone.EqualWithChecksums(original) {
+		t.Fatal("clone isn't equal to the original")
+	}
+
+	clone.Channel1Notes[0].NoteNum++
+	clone.Channel2Notes = append(clone.Channel2Notes[:1], bar())
+	clone.ProgramNumber++
+
+	if !original.Equal(testSequence()) {
+		t.Error("changing the clone changed the original")
+	}
+
+	if (*Sequence)(nil).Clone() != nil {
+		t.Error("clone of nil isn't nil")
+	}
+}
+
+func TestCheckGateLengths(t *testing.T) {
+	// a tie-like line, held for longer than its step
+	sequence := &Sequence{Channel2Notes: []NoteLine{note(1, 6, 6), note(2, 6, 12)}}
+
+	opts := defaultSequenceOptions
+
+	for _, mode := range []string{gateCheckOff, gateCheckWarn} {
+		opts.gateCheck = mode
+
+		if err := opts.checkGateLengths(sequence); err != nil {
+			t.Errorf("%s: err = %v, want nil", mode, err)
+		}
+	}
+
+	opts.gateCheck = gateCheckError
+
+	var lineErr *LineError
+	if err := opts.checkGateLengths(sequence); !errors.As(err, &lineErr) || !errors.Is(err, ErrGateExceedsStep) {
+		t.Fatalf("err = %v, want a LineError for ErrGateExceedsStep", err)
+	}
+
+	if lineErr.Channel != 2 || lineErr.Line != 1 || lineErr.Value != 12 {
+		t.Errorf("got channel %d, line %d, value %d, want channel 2, line 1, value 12", lineErr.Channel, lineErr.Line, lineErr.Value)
+	}
+}
+
+func TestNewNoteLine(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name       string
+		note       string
+		step, gate time.Duration
+		tempo      float64
+		want       NoteLine
+		err        error
+	}{
+		// at 120 BPM a clock pulse is 20.83ms
+		{name: "sixteenth", note: "C1", step: 125 * ms, gate: 62500 * time.Microsecond, tempo: 120, want: note(0, 6, 3)},
+		{name: "rounds down", note: "C#4", step: 135 * ms, gate: 10 * ms, tempo: 120, want: note(37, 6, 0)},
+		{name: "rounds up", note: "c#4", step: 136 * ms, gate: 11 * ms, tempo: 120, want: note(37, 7, 1)},
+		{name: "quarter at 90", note: "A3", step: 666667 * time.Microsecond, gate: 0, tempo: 90, want: note(33, 24, 0)},
+		{name: "highest note", note: "C6", step: 125 * ms, gate: 125 * ms, tempo: 120, want: note(60, 6, 6)},
+		{name: "too high", note: "C#6", step: 125 * ms, tempo: 120, err: ErrNoteOutOfRange},
+		{name: "not a note", note: "H2", step: 125 * ms, tempo: 120, err: ErrInvalidNoteName},
+		{name: "no octave", note: "C", step: 125 * ms, tempo: 120, err: ErrInvalidNoteName},
+		{name: "step too long", note: "C2", step: 10 * time.Second, tempo: 120, err: ErrStepOutOfRange},
+		{name: "gate too long", note: "C2", step: 125 * ms, gate: 10 * time.Second, tempo: 120, err: ErrGateOutOfRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewNoteLine(tt.note, tt.step, tt.gate, tt.tempo, false, false)
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewNoteLine("C2", time.Second, 0, 0, false, false); err == nil {
+		t.Error("a tempo of 0 didn't return an error")
+	}
+}
+
+func TestEmptySequenceWithinLimits(t *testing.T) {
+	sequence, err := Decode(bytes.NewReader(wavBytes(t, sampleRate, 1, generateEmptySequence(defaultAmplitude))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, line := range sequence.Channel1Notes {
+		if line.StepLength < MinStepLength || line.StepLength > MaxStepLength {
+			t.Errorf("note %d: step length %d is outside %d to %d", i, line.StepLength, MinStepLength, MaxStepLength)
+		}
+
+		if line.GateLength < MinGateLength || line.GateLength > MaxGateLength {
+			t.Errorf("note %d: gate length %d is outside %d to %d", i, line.GateLength, MinGateLength, MaxGateLength)
+		}
+	}
+}
+
+func TestSignChangeHysteresis(t *testing.T) {
+	// a swing from positive to negative with the signal jittering around
+	// zero in between
+	samples := []float64{0.5, 0.5, 0.004, -0.003, 0.002, -0.004, 0.001, -0.5, -0.5, -0.002, 0.003, 0.5}
+
+	if changes := sum(signChangeBits(samples, 0, false)); changes != 6 {
+		t.Errorf("without hysteresis: %d sign changes, want 6", changes)
+	}
+
+	bits := signChangeBits(samples, 0.01, false)
+
+	if want := []int{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}; !slices.Equal(bits, want) {
+		t.Errorf("with hysteresis: %v, want %v", bits, want)
+	}
+}
+
+func TestDecodeTooShort(t *testing.T) {
+	// the encoder only writes the headers along with the first samples, so
+	// a file with none is a file with one that has had it cut off
+	oneSample := wavBytes(t, sampleRate, 1, []int{100})
+
+	noSamples := slices.Clone(oneSample[:len(oneSample)-2])
+	binary.LittleEndian.PutUint32(noSamples[4:8], uint32(len(noSamples)-8))
+	binary.LittleEndian.PutUint32(noSamples[len(noSamples)-4:], 0)
+
+	tests := []struct {
+		name string
+		file []byte
+		err  error
+	}{
+		{"no samples", noSamples, ErrTooShort},
+		{"one sample", oneSample, ErrTooShort},
+		// long enough to hold a sequence, but there isn't one in it
+		{"a second of leader", wavBytes(t, sampleRate, 1, sequenceSamples(t, emptySequenceBytes)[:sampleRate]), ErrInvalidByteCount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(bytes.NewReader(tt.file))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeInvertedPolarity(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sequenceSamples(t, data)
+	inverted := make([]int, len(samples))
+
+	for i, sample := range samples {
+		inverted[i] = -sample
+	}
+
+	for name, samples := range map[string][]int{"original": samples, "inverted": inverted} {
+		sequence, err := Decode(bytes.NewReader(wavBytes(t, sampleRate, 1, samples)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !sequence.Equal(testSequence()) {
+			t.Errorf("%s: decoded to\n%v", name, sequence)
+		}
+	}
+}
+
+func TestDecodeOddChunkLayout(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := wavBytes(t, sampleRate, 1, sequenceSamples(t, data))
+
+	// put an odd-sized chunk, with its padding byte, between the fmt and
+	// data chunks, and cut the end off the file without changing the size
+	// the data chunk declares
+	fmtEnd := 12 + 8 + int(binary.LittleEndian.Uint32(file[16:20]))
+	junk := []byte{'j', 'u', 'n', 'k', 3, 0, 0, 0, 1, 2, 3, 0}
+
+	odd := append(append(slices.Clone(file[:fmtEnd]), junk...), file[fmtEnd:]...)
+	binary.LittleEndian.PutUint32(odd[4:8], uint32(len(odd)-8))
+	odd = odd[:len(odd)-sampleRate/4]
+
+	offset, declared, available, err := dataChunk(bytes.NewReader(odd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := int64(fmtEnd + len(junk) + 8); offset != want {
+		t.Errorf("data chunk at %d, want %d", offset, want)
+	}
+
+	if declared <= available {
+		t.Errorf("data chunk declares %d bytes with %d available, want more than are there", declared, available)
+	}
+
+	sequence, err := Decode(bytes.NewReader(odd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sequence.Equal(testSequence()) {
+		t.Errorf("decoded to\n%v", sequence)
+	}
+}
+
+func TestDecodeFramesPerBitNudge(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sequenceSamples(t, data)
+
+	// the samples are for 44100 Hz, where a bit period is 74.4 frames, so
+	// labelling them with a rate that rounds to a period a frame longer or
+	// shorter leaves the default strategy out of step by the end of the
+	// data buffer
+	tests := []struct {
+		rate     int
+		strategy string
+	}{
+		{sampleRate, "default"},
+		{44400, "fpb-1"},
+		{43200, "fpb+1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			decoder := wav.NewDecoder(bytes.NewReader(wavBytes(t, tt.rate, 1, samples)))
+			if err := checkWavFile(decoder); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := generateWavBytes(context.Background(), decoder, defaultDecodeOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Strategy != tt.strategy {
+				t.Errorf("decoded with %s, want %s", result.Strategy, tt.strategy)
+			}
+
+			if !bytes.Equal(result.Bytes, data) {
+				t.Errorf("decoded to % X, want % X", result.Bytes, data)
+			}
+
+			// the offsets are where the strategy read each byte, which at
+			// a nudged bit period isn't where the default would read it
+			if len(result.Offsets) != len(data) {
+				t.Fatalf("%d offsets for %d bytes", len(result.Offsets), len(data))
+			}
+
+			demod := newSignChangeDemodulator(result.SignBits, result.FramesPerBit)
+
+			// the last byte has no stop bits for readByteAt to find
+			for i, offset := range result.Offsets[:len(data)-1] {
+				if b, ok := readByteAt(demod, offset); !ok || b != data[i] {
+					t.Errorf("byte %d at frame %d reads as %02X, want %02X", i, offset, b, data[i])
+				}
+			}
+
+			timestamps := result.Timestamps()
+			if want := float64(result.Offsets[0]) / float64(tt.rate); timestamps[0] != want {
+				t.Errorf("first byte at %.3fs, want %.3fs", timestamps[0], want)
+			}
+		})
+	}
+}
+
+func TestGenerateDataBuffer(t *testing.T) {
+	samples := generateDataBuffer(defaultAmplitude)
+
+	framesPerBit := framesPerBitForRate(sampleRate)
+	demod := newSignChangeDemodulator(sampleBits(samples), framesPerBit)
+
+	if periods := len(samples) / framesPerBit; periods != dataBufferLength {
+		t.Errorf("buffer is %d bit periods, want %d", periods, dataBufferLength)
+	}
+
+	// the assembler reads each period from its last frame on, so the last
+	// period is checked against the start of what follows the buffer, which
+	// is the next byte's start bit
+	for i := 0; i < dataBufferLength-1; i++ {
+		if !demod.One(framesPerBit - 1 + i*framesPerBit) {
+			t.Errorf("bit period %d isn't a one bit", i)
+		}
+	}
+}
+
+// weakenStopBit removes sign changes from the first stop bit of the byte
+// whose start bit is at frame start, so it reads as neither a one nor a zero.
+func weakenStopBit(bits []int, start, framesPerBit int) {
+	// the assembler looks at each bit period from the last frame of the one
+	// before it
+	from := start + 9*framesPerBit - 1
+
+	removed := 0
+
+	for i := from + framesPerBit/4; i < from+framesPerBit && removed < 2; i++ {
+		if bits[i] == 1 {
+			bits[i] = 0
+			removed++
+		}
+	}
+}
+
+func TestStopBitTolerance(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sequenceSamples(t, data)
+
+	framesPerBit := framesPerBitForRate(sampleRate)
+	bits := sampleBits(samples)
+
+	_, offsets, err := assembleBytes(context.Background(), newSignChangeDemodulator(bits, framesPerBit), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stop bit in channel 1's lines, after the program number
+	weakenStopBit(bits, offsets[7], framesPerBit)
+
+	if got, _, err := assembleBytes(context.Background(), newSignChangeDemodulator(bits, framesPerBit), 0); err == nil && bytes.Equal(got, data) {
+		t.Error("the strict path decoded through a weak stop bit")
+	}
+
+	opts := defaultDecodeOptions
+	opts.stopBitTolerance = 1
+
+	got, _, _, err := assembleBytesStats(context.Background(), newSignChangeDemodulator(bits, framesPerBit), 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("decoded to % X, want % X", got, data)
+	}
+}
+
+func TestLeaderCheck(t *testing.T) {
+	// three seconds of a 440 Hz tone, which is music rather than a tape
+	music := make([]int, 3*sampleRate)
+	for i := range music {
+		music[i] = int(0x2000 * math.Sin(2*math.Pi*440*float64(i)/sampleRate))
+	}
+
+	_, err := Decode(bytes.NewReader(wavBytes(t, sampleRate, 1, music)))
+	if !errors.Is(err, ErrNoLeaderTone) {
+		t.Errorf("music: err = %v, want ErrNoLeaderTone", err)
+	}
+
+	opts := defaultDecodeOptions
+	opts.leaderWindow = 0
+
+	_, err = decodeSequence(context.Background(), bytes.NewReader(wavBytes(t, sampleRate, 1, music)), opts)
+	if err == nil || errors.Is(err, ErrNoLeaderTone) {
+		t.Errorf("music with no leader window: err = %v, want a decode error", err)
+	}
+
+	// a tape whose leader starts after a few seconds of silence
+	silence := make([]int, 3*sampleRate)
+	tape := append(silence, sequenceSamples(t, emptySequenceBytes)...)
+
+	if _, err := Decode(bytes.NewReader(wavBytes(t, sampleRate, 1, tape))); err != nil {
+		t.Errorf("tape after silence: %v", err)
+	}
+
+	opts = defaultDecodeOptions
+	opts.leaderWindow = 2 * time.Second
+
+	_, err = decodeSequence(context.Background(), bytes.NewReader(wavBytes(t, sampleRate, 1, tape)), opts)
+	if !errors.Is(err, ErrNoLeaderTone) {
+		t.Errorf("tape after silence with a window that ends before the leader: err = %v, want ErrNoLeaderTone", err)
+	}
+}
+
+func TestDecodeRightChannel(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sequenceSamples(t, data)
+
+	// a stereo recording with a dead left channel
+	stereo := make([]int, 2*len(samples))
+	for i, sample := range samples {
+		stereo[2*i+1] = sample
+	}
+
+	decoder := wav.NewDecoder(bytes.NewReader(wavBytes(t, sampleRate, 2, stereo)))
+	if err := checkWavFile(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := generateWavBytes(context.Background(), decoder, defaultDecodeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Strategy != rightStrategyName || !bytes.Equal(result.Bytes, data) {
+		t.Errorf("decoded % X with %s, want % X with %s", result.Bytes, result.Strategy, data, rightStrategyName)
+	}
+
+	// the same recording summed to mono from channels that almost cancel
+	// out, leaving the signal at about -36 dBFS
+	summed := make([]int, len(samples))
+	for i, sample := range samples {
+		summed[i] = sample - sample*94/100
+	}
+
+	sequence, err := Decode(bytes.NewReader(wavBytes(t, sampleRate, 1, summed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sequence.Equal(testSequence()) {
+		t.Errorf("summed to mono: decoded to\n%v", sequence)
+	}
+}
+
+// TestReadSamplesPartialFrame reads the right channel of a stereo file whose
+// data chunk ends with half a frame, to check the half frame isn't made up
+// into a whole one from whatever is left in the read buffer past it.
+func TestReadSamplesPartialFrame(t *testing.T) {
+	// three frames with a silent right channel, and the left sample of a
+	// fourth, which the encoder won't write, so it's added by hand
+	file := wavBytes(t, sampleRate, 2, []int{100, 0, 200, 0, 300, 0})
+
+	offset, declared, _, err := dataChunk(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file = binary.LittleEndian.AppendUint16(file, 400)
+	binary.LittleEndian.PutUint32(file[4:8], uint32(len(file)-8))
+	binary.LittleEndian.PutUint32(file[offset-4:offset], uint32(declared+2))
+
+	decoder := wav.NewDecoder(bytes.NewReader(file))
+	if err := checkWavFile(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	right, err := readSamples(context.Background(), decoder, signChangeOptions{channel: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []float64{0, 0, 0}; !slices.Equal(right, want) {
+		t.Errorf("read %v, want %v", right, want)
+	}
+}
+
+func TestDecodeAllSkipsBadTake(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	take := sequenceSamples(t, data)
+	framesPerBit := framesPerBitForRate(sampleRate)
+
+	_, offsets, err := assembleBytes(context.Background(), newSignChangeDemodulator(sampleBits(take), framesPerBit), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a dropout in the middle take's data buffer, after its program number
+	bad := slices.Clone(take)
+	dropout := offsets[3] + 40*framesPerBit
+	clear(bad[dropout : dropout+20*framesPerBit])
+
+	recording := append(append(slices.Clone(take), bad...), take...)
+
+	takes, err := DecodeAll(context.Background(), sampleBits(recording), framesPerBit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(takes) != 2 {
+		t.Fatalf("found %d takes, want 2", len(takes))
+	}
+
+	for i, want := range []int{0, 2 * len(take)} {
+		if !bytes.Equal(takes[i].Bytes, data) {
+			t.Errorf("take %d decoded to % X, want % X", i+1, takes[i].Bytes, data)
+		}
+
+		if takes[i].Start != want+offsets[0] {
+			t.Errorf("take %d starts at %d, want %d", i+1, takes[i].Start, want+offsets[0])
+		}
+	}
+}
+
+func TestMaxLineCountOption(t *testing.T) {
+	sequence := &Sequence{Header: Header{NumChannels: 1}, Channel1Notes: bars(DefaultMaxLineCount + 1)}
+
+	if _, err := encodeSequence(sequence, 0); !errors.Is(err, ErrInvalidLineCount) {
+		t.Fatalf("default limit: err = %v, want ErrInvalidLineCount", err)
+	}
+
+	opts := defaultSequenceOptions
+	opts.maxLineCount = DefaultMaxLineCount + 1
+
+	data, err := opts.encodeSequence(sequence, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateBytes(data); !errors.Is(err, ErrInvalidLineCount) {
+		t.Errorf("default limit: err = %v, want ErrInvalidLineCount", err)
+	}
+
+	parsed, err := opts.parseBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !parsed.Equal(sequence) {
+		t.Error("the raised limit didn't round trip the sequence")
+	}
+}
+
+// baselineGenerateBytes is the byte assembler as it was before the
+// Demodulator interface, with its circular buffer of sign changes, kept to
+// check the default path still reads the same bytes from the same frames. The
+// only change is that it records where each byte's start bit begins.
+func baselineGenerateBytes(bitstream []int, framerate int) ([]byte, []int, error) {
+	framesPerBit := int(float64(framerate)*4/BaseFreq + 0.5)
+	sample := make([]int, framesPerBit) // Slice to use as a circular buffer
+	var sampleIndex int                 // Current index in the sample buffer
+
+	// Fill the initial buffer with data
+	for i := 0; i < framesPerBit-1; i++ {
+		sample[i] = bitstream[i]
+	}
+
+	var (
+		result  []byte
+		offsets []int
+	)
+	signChanges := sum(sample) // Calculate initial sum of sign changes
+	bitstreamIndex := framesPerBit - 1
+
+	var (
+		foundMagicByte         bool
+		magicByteIndex         int
+		previousByte           byte
+		validByteIndex         int = -1
+		lastByteIndex          int
+		channel1LineCount      int
+		channel2LineCountIndex int = -1
+		insideBuffer           bool
+	)
+
+L1:
+	for bitstreamIndex < len(bitstream) {
+		if insideBuffer {
+			for i := 0; i < dataBufferLength; i++ {
+				if sum(bitstream[bitstreamIndex:bitstreamIndex+framesPerBit]) < 7 {
+					return nil, nil, fmt.Errorf("something went wrong: invalid data buffer")
+				}
+				bitstreamIndex += framesPerBit
+			}
+
+			insideBuffer = false
+
+			// Refill the sample buffer
+			for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
+				sample[sampleIndex] = bitstream[bitstreamIndex+i]
+				sampleIndex = (sampleIndex + 1) % framesPerBit
+			}
+
+			signChanges = sum(sample)
+
+			bitstreamIndex += framesPerBit
+		}
+
+		val := bitstream[bitstreamIndex]
+
+		if val > 0 {
+			signChanges++
+		}
+		if sample[sampleIndex] > 0 {
+			signChanges--
+		}
+
+		// Update the circular buffer
+		sample[sampleIndex] = val
+		sampleIndex = (sampleIndex + 1) % framesPerBit
+
+		if signChanges <= 4 {
+			var (
+				byteVal   uint16
+				byteStart = bitstreamIndex - framesPerBit + 1
+			)
+
+			for _, mask := range BitMasks {
+				if sum(bitstream[bitstreamIndex:bitstreamIndex+framesPerBit]) >= 7 {
+					byteVal |= mask
+				}
+				bitstreamIndex += framesPerBit
+			}
+
+			// short circuit if we have not found the magic byte yet
+			// therefore this must be invalid data
+			if !foundMagicByte && byteVal != magicByte {
+				continue
+			}
+
+			if foundMagicByte && (validByteIndex+1 == 1 || validByteIndex+1 == 2 || validByteIndex+1 == 3) {
+				if int(byteVal) < 0 || int(byteVal) > 9 {
+					// return to the frame after the initial incorrect byte and continue
+					foundMagicByte = false
+					bitstreamIndex = magicByteIndex + framesPerBit
+					validByteIndex = -1
+					magicByteIndex = 0
+					result = result[:0]
+					offsets = offsets[:0]
+
+					// Refill the sample buffer
+					for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
+						sample[sampleIndex] = bitstream[bitstreamIndex+i]
+						sampleIndex = (sampleIndex + 1) % framesPerBit
+					}
+
+					signChanges = sum(sample)
+
+					bitstreamIndex += framesPerBit
+
+					continue
+				}
+			}
+
+			if lastByteIndex == 0 || validByteIndex+1 != lastByteIndex {
+				for i := 0; i < 2; i++ {
+					if sum(bitstream[bitstreamIndex:bitstreamIndex+framesPerBit]) < 7 {
+						// return to the frame after the initial incorrect byte and continue
+						bitstreamIndex = bitstreamIndex - framesPerBit*(8+i)
+
+						if foundMagicByte {
+							foundMagicByte = false
+							bitstreamIndex = magicByteIndex + framesPerBit
+							validByteIndex = -1
+							magicByteIndex = 0
+							result = result[:0]
+							offsets = offsets[:0]
+						}
+
+						// Refill the sample buffer
+						for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
+							sample[sampleIndex] = bitstream[bitstreamIndex+i]
+							sampleIndex = (sampleIndex + 1) % framesPerBit
+						}
+
+						signChanges = sum(sample)
+
+						bitstreamIndex += framesPerBit
+
+						continue L1
+					}
+					bitstreamIndex += framesPerBit
+				}
+			}
+
+			// VALID BYTE
+			validByteIndex++
+
+			if byteVal == magicByte {
+				foundMagicByte = true
+				magicByteIndex = bitstreamIndex - framesPerBit*11
+			}
+
+			if validByteIndex == 5 {
+				channel1LineCount = int(binary.BigEndian.Uint16([]byte{previousByte, byte(byteVal)}))
+
+				channel2LineCountIndex = validByteIndex + channel1LineCount + 3 // checksum byte, line count byte 1, line count byte 2
+			}
+
+			if validByteIndex == channel2LineCountIndex {
+				lastByteIndex = validByteIndex + int(binary.BigEndian.Uint16([]byte{previousByte, byte(byteVal)})) - channel1LineCount + 1
+			}
+
+			result = append(result, byte(byteVal))
+			offsets = append(offsets, byteStart)
+
+			previousByte = byte(byteVal)
+
+			// check for last byte
+			if lastByteIndex != 0 && validByteIndex == lastByteIndex {
+				break
+			}
+
+			if validByteIndex == 3 {
+				insideBuffer = true
+				continue
+			}
+
+			// Refill the sample buffer
+			for i := 0; i < framesPerBit && bitstreamIndex+i < len(bitstream); i++ {
+				sample[sampleIndex] = bitstream[bitstreamIndex+i]
+				sampleIndex = (sampleIndex + 1) % framesPerBit
+			}
+
+			signChanges = sum(sample)
+
+			bitstreamIndex += framesPerBit
+		} else {
+			bitstreamIndex++
+		}
+	}
+
+	if len(result) != lastByteIndex+1 {
+		return nil, nil, fmt.Errorf("something went wrong: invalid number of bytes: %d", len(result))
+	}
+
+	return result, offsets, nil
+}
+
+func TestAssembleBytesMatchesBaseline(t *testing.T) {
+	sequences := []*Sequence{
+		{Header: Header{ProgramNumber: 123}},
+		testSequence(),
+		{Header: Header{ProgramNumber: 1}, Channel2Notes: []NoteLine{note(60, 6, 3), bar()}},
+		{Channel1Notes: []NoteLine{note(MaxNote, MaxStepLength, MaxGateLength)}},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 4; i++ {
+		sequences = append(sequences, randomSequence(rng))
+	}
+
+	framesPerBit := framesPerBitForRate(sampleRate)
+
+	for i, sequence := range sequences {
+		data, err := encodeSequence(sequence, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		samples := sequenceSamples(t, data)
+
+		// shifting the recording moves where each bit period starts
+		// relative to the frames the assemblers step through
+		for _, shift := range []int{0, 1, 17, framesPerBit - 1} {
+			bits := sampleBits(append(make([]int, shift), samples...))
+
+			want, wantOffsets, err := baselineGenerateBytes(bits, sampleRate)
+			if err != nil {
+				t.Fatalf("sequence %d, shift %d: baseline: %v", i, shift, err)
+			}
+
+			got, gotOffsets, err := assembleBytes(context.Background(), newSignChangeDemodulator(bits, framesPerBit), 0)
+			if err != nil {
+				t.Fatalf("sequence %d, shift %d: %v", i, shift, err)
+			}
+
+			if !bytes.Equal(got, want) || !bytes.Equal(got, data) {
+				t.Errorf("sequence %d, shift %d: got % X, baseline % X, want % X", i, shift, got, want, data)
+			}
+
+			// the last offset is the last byte's, which has no stop bits
+			if !slices.Equal(gotOffsets, wantOffsets) {
+				t.Errorf("sequence %d, shift %d: offsets %v, baseline %v", i, shift, gotOffsets, wantOffsets)
+			}
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		if err := selfTest(seed, defaultEncodeOptions); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestRandomNotesGateWithinStep(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	opts := defaultSequenceOptions
+	opts.gateCheck = gateCheckError
+
+	for i := 0; i < 200; i++ {
+		if err := opts.checkGateLengths(randomSequence(rng)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSignChangeDemodulatorMatchesSum(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	bits := make([]int, 1000)
+	for i := range bits {
+		bits[i] = rng.Intn(2)
+	}
+
+	for _, framesPerBit := range []int{1, 7, 73, 74, 75} {
+		demod := newSignChangeDemodulator(bits, framesPerBit)
+
+		for i := -1; i <= len(bits); i++ {
+			want := -1
+			if i >= 0 && i+framesPerBit <= len(bits) {
+				want = sum(bits[i : i+framesPerBit])
+			}
+
+			if got := demod.changes(i); got != want {
+				t.Fatalf("%d frames per bit: changes(%d) = %d, want %d", framesPerBit, i, got, want)
+			}
+
+			if demod.Zero(i) != (want >= 0 && want <= 4) || demod.One(i) != (want >= 7) {
+				t.Fatalf("%d frames per bit: frame %d with %d changes reads as zero %t, one %t", framesPerBit, i, want, demod.Zero(i), demod.One(i))
+			}
+		}
+	}
+}
+
+// sineTone returns frames samples of a sine wave at freq at the sample rate,
+// at half full scale.
+func sineTone(freq float64, frames int) []float64 {
+	samples := make([]float64, frames)
+	for i := range samples {
+		samples[i] = 0.5 * math.Sin(2*math.Pi*freq*float64(i)/sampleRate)
+	}
+
+	return samples
+}
+
+func TestGoertzel(t *testing.T) {
+	framesPerBit := framesPerBitForRate(sampleRate)
+	coeff := func(freq float64) float64 {
+		return 2 * math.Cos(2*math.Pi*freq/sampleRate)
+	}
+
+	// a bit period holds four cycles of the one frequency and two of the
+	// zero frequency, so a pure tone at one has next to no power at the
+	// other, and its power at its own is its energy times half the length
+	// of the period
+	for _, freq := range []float64{oneFreq, zeroFreq} {
+		period := sineTone(freq, framesPerBit)
+
+		var energy float64
+		for _, sample := range period {
+			energy += sample * sample
+		}
+
+		full := energy * float64(framesPerBit) / 2
+		other := float64(oneFreq + zeroFreq - freq)
+
+		if power := goertzel(period, coeff(freq)); math.Abs(power-full) > 0.05*full {
+			t.Errorf("%g Hz: power %g, want about %g", freq, power, full)
+		}
+
+		if power := goertzel(period, coeff(other)); power > 0.01*full {
+			t.Errorf("%g Hz: power at %g Hz is %g, want next to none of %g", freq, other, power, full)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+
+	noise := make([]float64, framesPerBit)
+	for i := range noise {
+		noise[i] = rng.Float64() - 0.5
+	}
+
+	// the end of a one bit running into a start bit, as the assembler sees
+	// the start bit a quarter of a period before it lines up with it
+	straddling := append(sineTone(oneFreq, framesPerBit)[:framesPerBit/4], sineTone(zeroFreq, framesPerBit)[framesPerBit/4:]...)
+
+	tests := []struct {
+		name      string
+		samples   []float64
+		zero, one bool
+	}{
+		{"one bit", sineTone(oneFreq, framesPerBit), false, true},
+		{"zero bit", sineTone(zeroFreq, framesPerBit), true, false},
+		{"silence", make([]float64, framesPerBit), false, false},
+		// too little of its energy is at either frequency
+		{"noise", noise, false, false},
+		// the zero frequency is the stronger, but not goertzelZeroRatio
+		// times stronger
+		{"straddling a start bit", straddling, false, false},
+	}
+
+	for _, tt := range tests {
+		demod := newGoertzelDemodulator(tt.samples, framesPerBit, sampleRate)
+
+		if zero, one := demod.Zero(0), demod.One(0); zero != tt.zero || one != tt.one {
+			t.Errorf("%s: zero %t, one %t, want zero %t, one %t", tt.name, zero, one, tt.zero, tt.one)
+		}
+	}
+}
+
+// noisyDemodulator returns the named demodulator reading 16 bit samples with
+// noise added.
+func noisyDemodulator(name string, samples []int, noise int, rng *rand.Rand) Demodulator {
+	floats := sampleFloats(addNoise(samples, noise, rng))
+	framesPerBit := framesPerBitForRate(sampleRate)
+
+	return newDemodulator(name, floats, signChangeBits(floats, 0, false), framesPerBit, sampleRate)
+}
+
+func TestGoertzelNoisyTape(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sequenceSamples(t, data)
+
+	// enough noise that the sign changes come too early or late to count
+	// half cycles by, which the tones' power still shows through
+	const noise = 0x1800
+
+	for _, tt := range []struct {
+		demod   string
+		decodes bool
+	}{
+		{"sign", false},
+		{"goertzel", true},
+	} {
+		demod := noisyDemodulator(tt.demod, samples, noise, rand.New(rand.NewSource(1)))
+
+		got, _, err := assembleBytes(context.Background(), demod, 0)
+		if decodes := err == nil && bytes.Equal(got, data); decodes != tt.decodes {
+			t.Errorf("%s: decoded %t, want %t (%v)", tt.demod, decodes, tt.decodes, err)
+		}
+	}
+}
+
+// warp resamples a recording at a speed that wanders sinusoidally by depth
+// either side of normal over period samples, like a tape with wow.
+func warp(samples []int, depth, period float64) []int {
+	var warped []int
+
+	for pos, i := 0.0, 0; pos < float64(len(samples)-1); i++ {
+		j := int(pos)
+		frac := pos - float64(j)
+
+		warped = append(warped, int(float64(samples[j])*(1-frac)+float64(samples[j+1])*frac))
+
+		pos += 1 + depth*math.Sin(2*math.Pi*float64(i)/period)
+	}
+
+	return warped
+}
+
+func TestAdaptiveClockWarpedTape(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := wavBytes(t, sampleRate, 1, warp(sequenceSamples(t, data), 0.02, sampleRate/2))
+
+	if _, err := decodeSequence(context.Background(), bytes.NewReader(file), defaultDecodeOptions); err == nil {
+		t.Error("the fixed bit period decoded the warped tape, so it doesn't show anything")
+	}
+
+	opts := defaultDecodeOptions
+	opts.adaptiveClock = true
+
+	sequence, err := decodeSequence(context.Background(), bytes.NewReader(file), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sequence.Equal(testSequence()) {
+		t.Errorf("decoded to\n%v", sequence)
+	}
+}
+
+// benchmarkBits returns the sign change bits of a recording of a long random
+// sequence.
+func benchmarkBits(b *testing.B) ([]byte, []int) {
+	b.Helper()
+
+	sequence := &Sequence{
+		Header:        Header{ProgramNumber: 1},
+		Channel1Notes: randomNotes(rand.New(rand.NewSource(1))),
+	}
+
+	for len(sequence.Channel1Notes) < 500 {
+		sequence.Channel1Notes = append(sequence.Channel1Notes, sequence.Channel1Notes...)
+	}
+
+	data, err := encodeSequence(sequence, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return data, sampleBits(sequenceSamples(b, data))
+}
+
+// BenchmarkAssembleBytes times the assembly alone, BenchmarkNewSignChangeDemodulator
+// the prefix sums it reads the bit periods from.
+func BenchmarkAssembleBytes(b *testing.B) {
+	data, bits := benchmarkBits(b)
+	demod := newSignChangeDemodulator(bits, framesPerBitForRate(sampleRate))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		got, _, err := assembleBytes(context.Background(), demod, 0)
+		if err != nil || !bytes.Equal(got, data) {
+			b.Fatalf("decoded % X, %v", got, err)
+		}
+	}
+}
+
+// BenchmarkAssembleBytesBaseline is the assembler that summed every window,
+// for comparison with BenchmarkAssembleBytes and BenchmarkNewSignChangeDemodulator
+// together.
+func BenchmarkAssembleBytesBaseline(b *testing.B) {
+	data, bits := benchmarkBits(b)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		got, _, err := baselineGenerateBytes(bits, sampleRate)
+		if err != nil || !bytes.Equal(got, data) {
+			b.Fatalf("decoded % X, %v", got, err)
+		}
+	}
+}
+
+func BenchmarkNewSignChangeDemodulator(b *testing.B) {
+	_, bits := benchmarkBits(b)
+	framesPerBit := framesPerBitForRate(sampleRate)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		newSignChangeDemodulator(bits, framesPerBit)
+	}
+}
+
+// discardFile is an io.WriteSeeker that throws away what's written to it, so
+// a benchmark of the encoder measures only what the encoder holds on to.
+type discardFile struct {
+	pos, size int64
+}
+
+func (f *discardFile) Write(p []byte) (int, error) {
+	f.pos += int64(len(p))
+	f.size = max(f.size, f.pos)
+	return len(p), nil
+}
+
+func (f *discardFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.pos = f.size + offset
+	}
+
+	return f.pos, nil
+}
+
+// BenchmarkStreamSequenceSamples encodes one save and then ten in a row, as
+// -join would. The bytes allocated per op grow with the number of saves only
+// as far as the samples of each section, not the whole recording.
+func BenchmarkStreamSequenceSamples(b *testing.B) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, saves := range []int{1, 10} {
+		b.Run(fmt.Sprintf("%d saves", saves), func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				err := writeWavStreamTo(&discardFile{}, nil, func(write func([]int) error) error {
+					for j := 0; j < saves; j++ {
+						if err := streamSequenceSamples(data, defaultEncodeOptions, write); err != nil {
+							return err
+						}
+					}
+
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAdaptiveClock decodes a tape with wow with a fixed bit period and
+// with the adaptive clock, reporting whether each decoded it.
+func BenchmarkAdaptiveClock(b *testing.B) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	file := wavBytes(b, sampleRate, 1, warp(sequenceSamples(b, data), 0.02, sampleRate/2))
+
+	for _, adaptive := range []bool{false, true} {
+		b.Run(fmt.Sprintf("adaptive %t", adaptive), func(b *testing.B) {
+			opts := defaultDecodeOptions
+			opts.adaptiveClock = adaptive
+
+			decoded := 0.0
+
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeSequence(context.Background(), bytes.NewReader(file), opts); err == nil {
+					decoded = 1
+				}
+			}
+
+			b.ReportMetric(decoded, "decoded")
+		})
+	}
+}
+
+// BenchmarkDemodulatorNoise decodes recordings with more and more noise
+// added, with each demodulator, reporting the share of them that decode.
+func BenchmarkDemodulatorNoise(b *testing.B) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	samples := sequenceSamples(b, data)
+
+	for _, noise := range []int{0x800, 0x1000, 0x1800, 0x2000, 0x2800, 0x3000} {
+		for _, name := range demodulatorNames {
+			b.Run(fmt.Sprintf("%s noise %#x", name, noise), func(b *testing.B) {
+				rng := rand.New(rand.NewSource(1))
+
+				decoded := 0
+
+				for i := 0; i < b.N; i++ {
+					demod := noisyDemodulator(name, samples, noise, rng)
+
+					if got, _, err := assembleBytes(context.Background(), demod, 0); err == nil && bytes.Equal(got, data) {
+						decoded++
+					}
+				}
+
+				b.ReportMetric(float64(decoded)/float64(b.N), "decoded")
+			})
+		}
+	}
+}
+
+// BenchmarkDecode decodes the same recording over and over, each time with a
+// new Decoder, so the allocations per op are those of decoding one file on
+// its own.
+func BenchmarkDecode(b *testing.B) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	file := wavBytes(b, sampleRate, 1, sequenceSamples(b, data))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(file)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBatchDecode decodes a batch of recordings the way batch decoding
+// does, through one Decoder, and with a new Decoder for every file, to show
+// what reusing the buffers saves.
+func BenchmarkBatchDecode(b *testing.B) {
+	const batchSize = 8
+
+	files := make([][]byte, batchSize)
+	for i := range files {
+		sequence := testSequence()
+		sequence.ProgramNumber = i
+
+		data, err := encodeSequence(sequence, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		files[i] = wavBytes(b, sampleRate, 1, sequenceSamples(b, data))
+	}
+
+	// decodeBatch decodes each file with the Decoder decoder returns for it
+	decodeBatch := func(b *testing.B, decoder func() *Decoder) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			for _, file := range files {
+				if _, err := decoder().Decode(bytes.NewReader(file)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	b.Run("one decoder", func(b *testing.B) {
+		d := NewDecoder()
+		decodeBatch(b, func() *Decoder { return d })
+	})
+
+	b.Run("decoder per file", func(b *testing.B) {
+		decodeBatch(b, NewDecoder)
+	})
+}
+
+// TestDecodeDegradedTrailer checks the trailing tone plays no part in a
+// decode: the save ends with its last byte, which the line counts locate, so
+// replacing the tone with noise or silence, or cutting it off, changes
+// nothing. Cutting into the last byte is reported as truncation.
+func TestDecodeDegradedTrailer(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sequenceSamples(t, data)
+	trailer := len(samples) - len(generateSamples(zeroFreq, trailerSeconds*zeroFreq, defaultAmplitude))
+	rng := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		name    string
+		degrade func([]int) []int
+		err     error
+	}{
+		{"noise", func(s []int) []int {
+			for i := trailer; i < len(s); i++ {
+				s[i] = rng.Intn(0xFFFF) - 0x7FFF
+			}
+			return s
+		}, nil},
+		{"silence", func(s []int) []int {
+			clear(s[trailer:])
+			return s
+		}, nil},
+		{"cut", func(s []int) []int {
+			return s[:trailer]
+		}, nil},
+		{"cut into the last byte", func(s []int) []int {
+			return s[:trailer-5*framesPerBitForRate(sampleRate)]
+		}, ErrTruncated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := wavBytes(t, sampleRate, 1, tt.degrade(slices.Clone(samples)))
+
+			got, err := Decode(bytes.NewReader(file))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			if tt.err == nil && !got.Equal(testSequence()) {
+				t.Errorf("decoded to\n%v", got)
+			}
+		})
+	}
+}
+
+func TestProgramConfidence(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := wav.NewDecoder(bytes.NewReader(wavBytes(t, sampleRate, 1, sequenceSamples(t, data))))
+	if err := checkWavFile(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := generateWavBytes(context.Background(), decoder, defaultDecodeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if confidence, doubts := programConfidence(result, defaultDecodeOptions); confidence != 1 {
+		t.Errorf("confidence %v in a clean recording: %v", confidence, doubts)
+	}
+
+	// without the offsets there's no magic byte to find the leader before
+	result.Offsets = nil
+
+	if confidence, doubts := programConfidence(result, defaultDecodeOptions); confidence != 0.5 || len(doubts) != 1 {
+		t.Errorf("confidence %v with reconciled takes: %v", confidence, doubts)
+	}
+}
+
+func TestNoteFrequencyAndCV(t *testing.T) {
+	tests := []struct {
+		note      int
+		frequency float64
+		cv        float64
+	}{
+		{0, 32.703, 0},
+		{12, 65.406, 1},
+		{45, 440, 3.75},
+		{57, 880, 4.75},
+		{60, 1046.502, 5},
+	}
+
+	for _, tt := range tests {
+		note := noteMap[tt.note]
+
+		if got := note.Frequency(); math.Abs(got-tt.frequency) > 0.001 {
+			t.Errorf("%v is %.3fHz, want %.3fHz", note, got, tt.frequency)
+		}
+
+		if got := note.CV(); got != tt.cv {
+			t.Errorf("%v is %gV, want %gV", note, got, tt.cv)
+		}
+	}
+}
+
+// musicXMLContent is the order the MusicXML schema puts the children of each
+// element the exporter writes in. Elements left out have no children.
+var musicXMLContent = map[string][]string{
+	"score-partwise": {"identification", "part-list", "part"},
+	"identification": {"encoding", "miscellaneous"},
+	"encoding":       {"software"},
+	"miscellaneous":  {"miscellaneous-field"},
+	"part-list":      {"score-part"},
+	"score-part":     {"part-name"},
+	"part":           {"measure"},
+	"measure":        {"attributes", "direction", "note"},
+	"attributes":     {"divisions", "clef"},
+	"clef":           {"sign", "line"},
+	"direction":      {"direction-type", "sound"},
+	"direction-type": {"metronome"},
+	"metronome":      {"beat-unit", "per-minute"},
+	"note":           {"pitch", "rest", "duration", "type", "dot", "notations"},
+	"pitch":          {"step", "alter", "octave"},
+	"notations":      {"articulations"},
+	"articulations":  {"accent"},
+}
+
+// checkMusicXML checks that doc is a MusicXML partwise score with every
+// element in the place the schema allows it. It's only part of what the
+// schema checks: it knows the order of the elements the exporter writes, not
+// which are required or what values they can take. TestMusicXMLSchema checks
+// the rest where the schema is at hand.
+func checkMusicXML(t *testing.T, doc []byte) {
+	t.Helper()
+
+	if !bytes.Contains(doc, []byte(musicXMLDoctype)) {
+		t.Error("no MusicXML doctype")
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+
+	type open struct {
+		name string
+		last int
+	}
+
+	var stack []open
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name := tok.Name.Local
+
+			if len(stack) == 0 {
+				if name != "score-partwise" {
+					t.Fatalf("root element %s", name)
+				}
+			} else {
+				parent := &stack[len(stack)-1]
+
+				i := slices.Index(musicXMLContent[parent.name], name)
+				if i < parent.last {
+					t.Fatalf("%s can't be in %s after what's before it", name, parent.name)
+				}
+
+				parent.last = i
+			}
+
+			stack = append(stack, open{name: name})
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 && musicXMLContent[stack[len(stack)-1].name] != nil && len(bytes.TrimSpace(tok)) > 0 {
+				t.Fatalf("text in %s", stack[len(stack)-1].name)
+			}
+		}
+	}
+}
+
+// musicXMLSequence returns the test sequence with notes added for each case
+// musicXMLMeasures handles: a dotted rest, a step of 0, a gate longer than its
+// step with no note type, and a bar.
+func musicXMLSequence() *Sequence {
+	sequence := testSequence()
+	sequence.Channel1Notes = append(sequence.Channel1Notes, note(1, 36, 0), note(2, 0, 6), note(3, 5, 10), bar(), note(4, 6, 6))
+
+	return sequence
+}
+
+// TestMusicXMLSchema validates an exported score against the MusicXML 4.0
+// schema with xmllint. The schema isn't kept in the repo, so MUSICXML_XSD
+// needs to be the path of a copy of musicxml.xsd, with the xml.xsd and
+// xlink.xsd it imports beside it. Without that or without xmllint the test is
+// skipped, leaving only checkMusicXML's check of the element order.
+func TestMusicXMLSchema(t *testing.T) {
+	schema := os.Getenv("MUSICXML_XSD")
+	if schema == "" {
+		t.Skip("MUSICXML_XSD isn't set")
+	}
+
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("xmllint isn't installed")
+	}
+
+	fileName := t.TempDir() + "/score.musicxml"
+	if err := writeMusicXML(fileName, musicXMLSequence(), 90); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(xmllint, "--noout", "--nonet", "--schema", schema, fileName).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+func TestMarshalMusicXML(t *testing.T) {
+	sequence := musicXMLSequence()
+
+	doc, err := marshalMusicXML(sequence, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkMusicXML(t, doc)
+
+	var score musicXMLScore
+	if err := xml.Unmarshal(doc, &score); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(score.Parts) != 2 {
+		t.Fatalf("%d parts, want one for each channel", len(score.Parts))
+	}
+
+	// what's drawn in each measure, a pitch or a rest with its duration and
+	// type, and > for an accent
+	drawn := func(part musicXMLPart) [][]string {
+		var measures [][]string
+
+		for _, measure := range part.Measures {
+			notes := []string{}
+
+			for _, note := range measure.Notes {
+				s := "rest"
+				if note.Pitch != nil {
+					s = fmt.Sprintf("%s%+d/%d", note.Pitch.Step, note.Pitch.Alter, note.Pitch.Octave)
+				}
+
+				s += fmt.Sprintf(" %d %s", note.Duration, note.Type)
+				if note.Dot != nil {
+					s += "."
+				}
+				if note.Notations != nil {
+					s += " >"
+				}
+
+				notes = append(notes, s)
+			}
+
+			measures = append(measures, notes)
+		}
+
+		return measures
+	}
+
+	want := [][][]string{
+		{
+			{"C+0/2 3 32nd", "rest 3 32nd"},
+			{"C+0/1 12 eighth", "C+0/6 12 eighth >", "rest 12 eighth", "rest 36 quarter.", "D+1/1 5 "},
+			{"E+0/1 6 16th"},
+		},
+		// the second channel has an empty measure before its first bar, and
+		// an empty one to line up with the first channel's third
+		{
+			{},
+			{"C+0/4 6 16th"},
+			{},
+		},
+	}
+
+	for i, part := range score.Parts {
+		if got := drawn(part); fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("part %d is\n%q\nwant\n%q", i+1, got, want[i])
+		}
+	}
+
+	if first := score.Parts[0].Measures[0]; first.Attributes == nil || first.Attributes.Divisions != ClockPPQN || first.Direction == nil || first.Direction.PerMinute != 90 {
+		t.Errorf("first measure doesn't set the divisions and tempo: %+v", first)
+	}
+
+	if _, err := marshalMusicXML(sequence, 0); err == nil {
+		t.Error("a tempo of 0 was accepted")
+	}
+}
+
+// TestAssembleBytesStartOffset checks that starting the assembly up to two bit
+// periods into the leader tone never changes what it finds. It looks for a
+// start bit at every frame, so starting later only skips frames of leader
+// before the first one. That holds for recordings noisy enough not to decode
+// too, which the heavier levels of noise here are: no start offset rescues
+// them.
+func TestAssembleBytesStartOffset(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sequenceSamples(t, data)
+	framesPerBit := framesPerBitForRate(sampleRate)
+	rng := rand.New(rand.NewSource(1))
+
+	for _, noise := range []int{0, 0x800, 0x1000, 0x1800, 0x2000} {
+		demod := newSignChangeDemodulator(sampleBits(addNoise(samples, noise, rng)), framesPerBit)
+
+		want, wantOffsets, wantErr := assembleBytes(context.Background(), demod, 0)
+
+		for from := 1; from <= 2*framesPerBit; from++ {
+			got, offsets, err := assembleBytes(context.Background(), demod, from)
+
+			if (err == nil) != (wantErr == nil) || !bytes.Equal(got, want) || !slices.Equal(offsets, wantOffsets) {
+				t.Fatalf("noise %#x: starting at frame %d decoded % X at %v, %v; from the start % X at %v, %v", noise, from, got, offsets, err, want, wantOffsets, wantErr)
+			}
+		}
+	}
+}
+
+func TestReadBits(t *testing.T) {
+	bits := []int{0, 0, 1, 1, 0, 0, 0, 0, 0, 0, 1, 1, 0, 0, 0, 1}
+
+	text := t.TempDir() + "/bits.txt"
+	if err := writeBits(text, bits); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readBits(text, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(got, bits) {
+		t.Errorf("text: read %v, want %v", got, bits)
+	}
+
+	// the packed bits are the bytes of "01", which would read as two bits
+	// of text
+	packed := t.TempDir() + "/bits.bin"
+	if err := os.WriteFile(packed, []byte("01"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = readBits(packed, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(got, bits) {
+		t.Errorf("packed: read %v, want %v", got, bits)
+	}
+
+	if err := os.WriteFile(packed, []byte{0x80, 0x01}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readBits(packed, false); err == nil {
+		t.Error("read a packed file as text")
+	}
+}
+
+func TestWriteBitsImage(t *testing.T) {
+	data, err := encodeSequence(testSequence(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := wav.NewDecoder(bytes.NewReader(wavBytes(t, sampleRate, 1, sequenceSamples(t, data))))
+	if err := checkWavFile(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := generateWavBytes(context.Background(), decoder, defaultDecodeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// margin returns the colour index of the margin of each row
+	margin := func(result *DecodeResult) []uint8 {
+		t.Helper()
+
+		fileName := t.TempDir() + "/bits.png"
+		if err := writeBitsImage(fileName, result); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		img, err := png.Decode(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paletted := img.(*image.Paletted)
+
+		var colours []uint8
+		for row := 0; row < paletted.Bounds().Dy(); row++ {
+			colours = append(colours, paletted.ColorIndexAt(0, row))
+		}
+
+		return colours
+	}
+
+	colours := margin(result)
+	for i, offset := range result.Offsets {
+		if got, want := colours[offset/result.FramesPerBit], uint8(2+i%2); got != want {
+			t.Fatalf("byte %d marked in colour %d, want %d", i, got, want)
+		}
+	}
+
+	// with reconciled takes there are no offsets and nothing is marked
+	result.Offsets = nil
+
+	if colours := margin(result); slices.ContainsFunc(colours, func(c uint8) bool { return c != 0 }) {
+		t.Error("rows marked without offsets")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/go-audio/wav"
+)
+
+// quietLeaderPeak is the peak level, as a fraction of full scale, below which
+// a recording with a clear leader tone is quiet enough to have been summed to
+// mono from channels that cancel out. It's about -30 dBFS.
+//
+// The tape output is often recorded in stereo, with the same signal in both
+// channels. Summing the channels to mono, as some capture devices and
+// software do, is harmless while they're in phase, but if one is inverted, or
+// delayed by a misaligned head, most of the signal cancels out and what's left
+// is a quiet tone close to the noise floor. When that doesn't decode, nothing
+// more can be got from the mono file, but a stereo original can be decoded
+// instead, and the right strategy reads its second channel if the first
+// doesn't decode.
+const quietLeaderPeak = 0.03
+
+// summedToMono reports whether a mono file that didn't decode looks like one
+// summed from cancelling channels: the leader tone is there, but quietly. It
+// returns the peak level of the leader window. The leader is looked for
+// without hysteresis, since that can be what hides it.
+func summedToMono(ctx context.Context, decoder *wav.Decoder, opts decodeOptions) (bool, float64) {
+	if decoder.NumChans != 1 {
+		return false, 0
+	}
+
+	opts.hysteresis = 0
+	if opts.leaderWindow <= 0 {
+		opts.leaderWindow = defaultLeaderWindow
+	}
+
+	samples, err := readLeaderWindow(ctx, decoder, opts, 0)
+	if err != nil {
+		return false, 0
+	}
+
+	defer opts.buffers.putSamples(samples)
+
+	peak := measureLevels(samples).Peak
+	if peak >= quietLeaderPeak {
+		return false, peak
+	}
+
+	return hasLeaderTone(signChangeBits(samples, 0, false), int(decoder.SampleRate), opts.leaderTolerance), peak
+}
+
+// warnSummedToMono prints a hint to stderr if a mono file that didn't decode
+// looks like it was summed from cancelling channels.
+func warnSummedToMono(decoder *wav.Decoder, opts decodeOptions) {
+	summed, peak := summedToMono(context.Background(), decoder, opts)
+	if !summed {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "the leader tone is there but peaks at only %.1f dBFS, which is how a stereo recording summed to mono sounds when its channels cancel out; if you have the stereo original, decode that instead\n", dBFS(peak))
+
+	if opts.hysteresis >= peak {
+		fmt.Fprintf(os.Stderr, "-hysteresis %g is above the recording's peak level of %.3f, so no sign changes are read at all\n", opts.hysteresis, peak)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// musicXMLDoctype is the document type declaration of a MusicXML partwise
+// score, which notation software looks for before reading the rest.
+const musicXMLDoctype = `<!DOCTYPE score-partwise PUBLIC "-//Recordare//DTD MusicXML 4.0 Partwise//EN" "http://www.musicxml.org/dtds/partwise.dtd">`
+
+// The elements of a MusicXML partwise score that the exporter writes, in the
+// order the schema puts them.
+type (
+	musicXMLScore struct {
+		XMLName        xml.Name               `xml:"score-partwise"`
+		Version        string                 `xml:"version,attr"`
+		Identification musicXMLIdentification `xml:"identification"`
+		PartList       []musicXMLScorePart    `xml:"part-list>score-part"`
+		Parts          []musicXMLPart         `xml:"part"`
+	}
+
+	musicXMLIdentification struct {
+		Encoding      string                  `xml:"encoding>software"`
+		Miscellaneous []musicXMLMiscellaneous `xml:"miscellaneous>miscellaneous-field"`
+	}
+
+	musicXMLMiscellaneous struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+	}
+
+	musicXMLScorePart struct {
+		ID       string `xml:"id,attr"`
+		PartName string `xml:"part-name"`
+	}
+
+	musicXMLPart struct {
+		ID       string            `xml:"id,attr"`
+		Measures []musicXMLMeasure `xml:"measure"`
+	}
+
+	musicXMLMeasure struct {
+		Number     int                 `xml:"number,attr"`
+		Attributes *musicXMLAttributes `xml:"attributes"`
+		Direction  *musicXMLDirection  `xml:"direction"`
+		Notes      []musicXMLNote      `xml:"note"`
+	}
+
+	musicXMLAttributes struct {
+		Divisions int          `xml:"divisions"`
+		Clef      musicXMLClef `xml:"clef"`
+	}
+
+	musicXMLClef struct {
+		Sign string `xml:"sign"`
+		Line int    `xml:"line"`
+	}
+
+	musicXMLDirection struct {
+		Placement string  `xml:"placement,attr"`
+		BeatUnit  string  `xml:"direction-type>metronome>beat-unit"`
+		PerMinute float64 `xml:"direction-type>metronome>per-minute"`
+		Sound     struct {
+			Tempo float64 `xml:"tempo,attr"`
+		} `xml:"sound"`
+	}
+
+	musicXMLNote struct {
+		Pitch     *musicXMLPitch     `xml:"pitch"`
+		Rest      *struct{}          `xml:"rest"`
+		Duration  int                `xml:"duration"`
+		Type      string             `xml:"type,omitempty"`
+		Dot       *struct{}          `xml:"dot"`
+		Notations *musicXMLNotations `xml:"notations"`
+	}
+
+	musicXMLPitch struct {
+		Step   string `xml:"step"`
+		Alter  int    `xml:"alter,omitempty"`
+		Octave int    `xml:"octave"`
+	}
+
+	musicXMLNotations struct {
+		Accent struct{} `xml:"articulations>accent"`
+	}
+)
+
+// musicXMLSteps and musicXMLAlters spell each note of the octave, in the
+// order of noteNames, as a MusicXML step and how many semitones it's raised.
+var (
+	musicXMLSteps  = []string{"C", "C", "D", "D", "E", "F", "F", "G", "G", "A", "A", "B"}
+	musicXMLAlters = []int{0, 1, 0, 1, 0, 0, 1, 0, 1, 0, 1, 0}
+)
+
+// musicXMLTypes are the note types MusicXML draws, by their length in quarter
+// note beats, from a whole note down to a thirty-second.
+var musicXMLTypes = []struct {
+	beats float64
+	name  string
+}{
+	{4, "whole"},
+	{2, "half"},
+	{1, "quarter"},
+	{0.5, "eighth"},
+	{0.25, "16th"},
+	{0.125, "32nd"},
+}
+
+// musicXMLType returns the note type and whether it's dotted for a length in
+// clock pulses. A length that isn't one of the types, plain or dotted, such as
+// a triplet, has no type, which leaves notation software to work it out from
+// the duration.
+func musicXMLType(step int) (string, bool) {
+	beats := StepToBeats(step, ClockPPQN)
+
+	for _, t := range musicXMLTypes {
+		switch beats {
+		case t.beats:
+			return t.name, false
+		case t.beats * 1.5:
+			return t.name, true
+		}
+	}
+
+	return "", false
+}
+
+// musicXMLDuration returns a note or rest lasting step clock pulses. A pitch
+// of nil makes a rest.
+func musicXMLDuration(pitch *musicXMLPitch, step int) musicXMLNote {
+	note := musicXMLNote{Pitch: pitch, Duration: step}
+	if pitch == nil {
+		note.Rest = &struct{}{}
+	}
+
+	name, dotted := musicXMLType(step)
+	note.Type = name
+	if dotted {
+		note.Dot = &struct{}{}
+	}
+
+	return note
+}
+
+// musicXMLMeasures returns a channel's notes as measures, with a measure
+// ending at each bar. Durations are in clock pulses, which is why the score's
+// divisions are ClockPPQN. A note sounds for its gate length and is followed
+// by a rest for the rest of its step, or lasts the whole step if its gate
+// does; a gate of 0 never sounds, so its step is all rest. A step of 0 takes
+// no time and has nothing to draw, so it's left out.
+func musicXMLMeasures(notes []NoteLine) [][]musicXMLNote {
+	var (
+		measures [][]musicXMLNote
+		measure  []musicXMLNote
+	)
+
+	for _, note := range notes {
+		if note.Bar {
+			measures = append(measures, measure)
+			measure = nil
+			continue
+		}
+
+		if note.StepLength == 0 {
+			continue
+		}
+
+		if note.GateLength == 0 {
+			measure = append(measure, musicXMLDuration(nil, note.StepLength))
+			continue
+		}
+
+		pitch := &musicXMLPitch{
+			Step:   musicXMLSteps[note.NoteNum%12],
+			Alter:  musicXMLAlters[note.NoteNum%12],
+			Octave: noteMap[note.NoteNum].Octave,
+		}
+
+		sounding := musicXMLDuration(pitch, min(note.GateLength, note.StepLength))
+		if note.Accent {
+			sounding.Notations = &musicXMLNotations{}
+		}
+
+		measure = append(measure, sounding)
+
+		if note.GateLength < note.StepLength {
+			measure = append(measure, musicXMLDuration(nil, note.StepLength-note.GateLength))
+		}
+	}
+
+	// a channel that ends with a bar has nothing after it
+	if len(measure) > 0 || len(measures) == 0 {
+		measures = append(measures, measure)
+	}
+
+	return measures
+}
+
+// playingTime returns how long one pass through the notes takes at tempo, in
+// milliseconds.
+func playingTime(notes []NoteLine, tempo float64) float64 {
+	var millis float64
+
+	for _, note := range notes {
+		if !note.Bar {
+			millis += StepToMillis(note.StepLength, ClockPPQN, tempo)
+		}
+	}
+
+	return millis
+}
+
+// newMusicXMLScore returns the sequence as a MusicXML score with a part for
+// each channel at tempo beats per minute. MusicXML lines the parts up by
+// measure number, so the part with fewer bars is filled out with empty
+// measures. The identification records the program number, how long the
+// sequence plays for and how long its tape recording is.
+func newMusicXMLScore(sequence *Sequence, tempo float64) *musicXMLScore {
+	channels := [][]NoteLine{sequence.Channel1Notes}
+	if sequence.NumChannels == 2 {
+		channels = append(channels, sequence.Channel2Notes)
+	}
+
+	score := &musicXMLScore{
+		Version: "4.0",
+		Identification: musicXMLIdentification{
+			Encoding: "mc-202-librarian",
+			Miscellaneous: []musicXMLMiscellaneous{
+				{Name: "program-number", Value: strconv.Itoa(sequence.ProgramNumber)},
+				{Name: "tape-duration", Value: fmt.Sprintf("%.2fs", ExpectedDuration(sequence, sampleRate, leaderSeconds, trailerSeconds))},
+			},
+		},
+	}
+
+	var parts [][][]musicXMLNote
+
+	longest := 0
+
+	for i, notes := range channels {
+		id := fmt.Sprintf("P%d", i+1)
+
+		score.PartList = append(score.PartList, musicXMLScorePart{ID: id, PartName: fmt.Sprintf("Channel %d", i+1)})
+		score.Identification.Miscellaneous = append(score.Identification.Miscellaneous, musicXMLMiscellaneous{
+			Name:  fmt.Sprintf("channel-%d-playing-time", i+1),
+			Value: fmt.Sprintf("%.2fs", playingTime(notes, tempo)/1000),
+		})
+
+		measures := musicXMLMeasures(notes)
+		longest = max(longest, len(measures))
+		parts = append(parts, measures)
+	}
+
+	for i, measures := range parts {
+		part := musicXMLPart{ID: score.PartList[i].ID}
+
+		for j := 0; j < longest; j++ {
+			measure := musicXMLMeasure{Number: j + 1}
+			if j < len(measures) {
+				measure.Notes = measures[j]
+			}
+
+			if j == 0 {
+				measure.Attributes = &musicXMLAttributes{Divisions: ClockPPQN, Clef: musicXMLClef{Sign: "G", Line: 2}}
+			}
+
+			// the tempo is marked once, above the top part
+			if j == 0 && i == 0 {
+				measure.Direction = &musicXMLDirection{Placement: "above", BeatUnit: "quarter", PerMinute: tempo}
+				measure.Direction.Sound.Tempo = tempo
+			}
+
+			part.Measures = append(part.Measures, measure)
+		}
+
+		score.Parts = append(score.Parts, part)
+	}
+
+	return score
+}
+
+// marshalMusicXML returns the sequence as a MusicXML document at tempo beats
+// per minute.
+func marshalMusicXML(sequence *Sequence, tempo float64) ([]byte, error) {
+	if tempo <= 0 {
+		return nil, fmt.Errorf("invalid tempo: %g", tempo)
+	}
+
+	body, err := xml.MarshalIndent(newMusicXMLScore(sequence, tempo), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	doc := []byte(xml.Header + musicXMLDoctype + "\n")
+	doc = append(doc, body...)
+
+	return append(doc, '\n'), nil
+}
+
+// writeMusicXML writes the sequence to a MusicXML file at tempo beats per
+// minute, for opening in notation software.
+func writeMusicXML(fileName string, sequence *Sequence, tempo float64) error {
+	doc, err := marshalMusicXML(sequence, tempo)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, doc, 0644)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// barMarker stands in for a bar in a pitch list.
+const barMarker = "|"
+
+// pitchList returns the pitches of a channel's notes in order, as note names
+// with their octave, such as C#3, leaving out the timing. Bars are marked with
+// barMarker.
+func pitchList(notes []NoteLine) []string {
+	pitches := make([]string, 0, len(notes))
+
+	for _, note := range notes {
+		if note.Bar {
+			pitches = append(pitches, barMarker)
+			continue
+		}
+
+		pitches = append(pitches, noteMap[note.NoteNum].String())
+	}
+
+	return pitches
+}
+
+// printPitches prints the pitches of each channel on a line of its own or, if
+// interleave is set, both channels on one line, taking a line from each in
+// turn.
+func printPitches(sequence *Sequence, interleave bool) {
+	channel1 := pitchList(sequence.Channel1Notes)
+	channel2 := pitchList(sequence.Channel2Notes)
+
+	if !interleave {
+		fmt.Println(strings.Join(channel1, " "))
+
+		if sequence.NumChannels == 2 {
+			fmt.Println(strings.Join(channel2, " "))
+		}
+
+		return
+	}
+
+	var pitches []string
+
+	for i := 0; i < max(len(channel1), len(channel2)); i++ {
+		if i < len(channel1) {
+			pitches = append(pitches, channel1[i])
+		}
+
+		if i < len(channel2) {
+			pitches = append(pitches, channel2[i])
+		}
+	}
+
+	fmt.Println(strings.Join(pitches, " "))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// The stages of a decode -profile times, in the order they happen.
+const (
+	profileLeader     = "leader check"
+	profileRead       = "reading samples"
+	profileSignChange = "sign change extraction"
+	profileAssembly   = "byte assembly"
+	profileParse      = "parsing"
+)
+
+var profileStages = []string{profileLeader, profileRead, profileSignChange, profileAssembly, profileParse}
+
+// decodeProfile adds up how long each stage of a decode took, over every
+// strategy that was tried, and how much data went through them. A nil
+// decodeProfile records nothing, so the stages can be timed unconditionally.
+type decodeProfile struct {
+	stages   map[string]time.Duration
+	samples  int
+	signBits int
+	bytes    int
+	attempts int
+}
+
+func newDecodeProfile() *decodeProfile {
+	return &decodeProfile{stages: make(map[string]time.Duration)}
+}
+
+// since adds the time since start to the stage.
+func (p *decodeProfile) since(stage string, start time.Time) {
+	if p == nil {
+		return
+	}
+
+	p.stages[stage] += time.Since(start)
+}
+
+// attempt records a strategy's attempt at assembling bytes from the samples
+// and sign change bits it read.
+func (p *decodeProfile) attempt(samples, signBits, bytes int) {
+	if p == nil {
+		return
+	}
+
+	p.samples += samples
+	p.signBits += signBits
+	p.bytes += bytes
+	p.attempts++
+}
+
+// print writes the time each stage took, and its share of the total, as a
+// table to stderr, followed by how much data was processed.
+func (p *decodeProfile) print() {
+	var total time.Duration
+	for _, stage := range profileStages {
+		total += p.stages[stage]
+	}
+
+	fmt.Fprintf(os.Stderr, "%-24s %12s %7s\n", "Stage", "Time", "Share")
+
+	for _, stage := range profileStages {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(p.stages[stage]) / float64(total)
+		}
+
+		fmt.Fprintf(os.Stderr, "%-24s %12v %6.1f%%\n", stage, p.stages[stage].Round(time.Microsecond), share)
+	}
+
+	fmt.Fprintf(os.Stderr, "%-24s %12v\n", "total", total.Round(time.Microsecond))
+	fmt.Fprintf(os.Stderr, "Samples: %d, sign change bits: %d, bytes: %d, over %d attempts\n", p.samples, p.signBits, p.bytes, p.attempts)
+}
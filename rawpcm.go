@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rawPCMBitDepths are the sample sizes -raw-pcm can read, the same as the
+// integer formats readSamples reads from wav files.
+var rawPCMBitDepths = []int{16, 24, 32}
+
+// rawPCMBitDepthNames returns the bit depths -raw-pcm can read as a list.
+func rawPCMBitDepthNames() string {
+	var names []string
+	for _, bitDepth := range rawPCMBitDepths {
+		names = append(names, strconv.Itoa(bitDepth))
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// rawPCMFormat describes a file of raw PCM samples, which has no header to
+// say so itself. Samples are signed little-endian integers with the channels
+// interleaved, the way a wav file's data chunk stores them.
+type rawPCMFormat struct {
+	rate     int
+	bitDepth int
+	channels int
+}
+
+// check returns an error naming whichever of the format's fields weren't
+// given or can't be read.
+func (f rawPCMFormat) check() error {
+	var missing []string
+
+	if f.rate <= 0 {
+		missing = append(missing, "-rate")
+	}
+
+	if f.bitDepth == 0 {
+		missing = append(missing, "-bit-depth")
+	}
+
+	if f.channels <= 0 {
+		missing = append(missing, "-pcm-channels")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("raw PCM needs %s", strings.Join(missing, ", "))
+	}
+
+	for _, bitDepth := range rawPCMBitDepths {
+		if f.bitDepth == bitDepth {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported bit depth: %d, must be one of %s", f.bitDepth, rawPCMBitDepthNames())
+}
+
+// readRawSamples reads the first channel of raw PCM samples from r, normalized
+// to ±1, from startFrame up to endFrame, or the end if endFrame is 0. A frame
+// cut short at the end of the file is ignored.
+func readRawSamples(r io.Reader, format rawPCMFormat, startFrame, endFrame int) ([]float64, error) {
+	var samples []float64
+
+	sampleBytes := format.bitDepth / 8
+	frame := make([]byte, sampleBytes*format.channels)
+	fullScale := float64(int(1) << (format.bitDepth - 1))
+	shift := 32 - format.bitDepth
+
+	br := bufio.NewReader(r)
+
+	for i := 0; endFrame == 0 || i < endFrame; i++ {
+		if _, err := io.ReadFull(br, frame); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		if i < startFrame {
+			continue
+		}
+
+		var value uint32
+		for b := 0; b < sampleBytes; b++ {
+			value |= uint32(frame[b]) << (8 * b)
+		}
+
+		// shift the sample up to the top of the word and back down to sign
+		// extend it
+		samples = append(samples, float64(int32(value<<shift)>>shift)/fullScale)
+	}
+
+	return samples, nil
+}
+
+// decodeRawPCMFile reads a file of raw PCM samples and decodes the bytes they
+// contain. The decode strategies that read the samples differently from the
+// wav decoder don't apply, but the rest are tried in turn as they are for wav
+// files.
+func decodeRawPCMFile(fileName string, format rawPCMFormat, opts decodeOptions) *DecodeResult {
+	f, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	startFrame := int(opts.startSec * float64(format.rate))
+	endFrame := int(opts.endSec * float64(format.rate))
+
+	if opts.startSec < 0 || opts.endSec < 0 || (endFrame > 0 && endFrame <= startFrame) {
+		fmt.Fprintf(os.Stderr, "%v: start %.3fs, end %.3fs\n", ErrInvalidTimeRange, opts.startSec, opts.endSec)
+		os.Exit(1)
+	}
+
+	start := time.Now()
+
+	samples, err := readRawSamples(f, format, startFrame, endFrame)
+
+	opts.profile.since(profileRead, start)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "problem reading raw PCM:", err)
+		os.Exit(1)
+	}
+
+	start = time.Now()
+
+	if err := checkLeaderSamples(samples, format.rate, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	opts.profile.since(profileLeader, start)
+
+	var firstErr error
+
+	for _, strategy := range decodeStrategies {
+		if strategy.opts.prime || strategy.opts.channel != 0 {
+			continue
+		}
+
+		result, err := strategy.decodeSamples(context.Background(), samples, format.rate, opts)
+		if err == nil {
+			result.Strategy = strategy.name
+			result.SampleRate = format.rate
+			result.FramesPerBit = strategy.framesPerBit(format.rate)
+			result.StartFrame = startFrame
+
+			return result
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, firstErr)
+
+	var truncated *TruncatedError
+	if errors.As(firstErr, &truncated) {
+		writePartial(strings.TrimSuffix(fileName, path.Ext(fileName))+"_partial.json", truncated, opts)
+	}
+
+	os.Exit(1)
+
+	return nil
+}
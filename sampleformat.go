@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-audio/wav"
+)
+
+// wavFormatFloat is the wav header's audio format for IEEE float samples.
+const wavFormatFloat = 3
+
+// sampleFormat is how the samples in a wav file's data chunk are stored.
+type sampleFormat struct {
+	bitDepth int
+	float    bool
+}
+
+// sampleFormats are the formats -sample-format can force a file to be read
+// as, for files whose header doesn't describe their data.
+var sampleFormats = map[string]sampleFormat{
+	"pcm16":   {bitDepth: 16},
+	"pcm24":   {bitDepth: 24},
+	"pcm32":   {bitDepth: 32},
+	"float32": {bitDepth: 32, float: true},
+}
+
+// sampleFormatNames returns the names of the sample formats, sorted.
+func sampleFormatNames() string {
+	var names []string
+	for name := range sampleFormats {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// headerSampleFormat returns the sample format the wav file's header declares.
+func headerSampleFormat(decoder *wav.Decoder) sampleFormat {
+	return sampleFormat{
+		bitDepth: int(decoder.BitDepth),
+		float:    decoder.WavAudioFormat == wavFormatFloat,
+	}
+}
+
+// warnSampleFormat prints a warning if the sample format the file is being
+// forced to be read as isn't the one its header declares.
+func warnSampleFormat(decoder *wav.Decoder, opts decodeOptions) {
+	if opts.sampleFormat == "" {
+		return
+	}
+
+	header := headerSampleFormat(decoder)
+	if header == sampleFormats[opts.sampleFormat] {
+		return
+	}
+
+	declared := fmt.Sprintf("pcm%d", header.bitDepth)
+	if header.float {
+		declared = fmt.Sprintf("float%d", header.bitDepth)
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: the header says the samples are %s but they're being read as %s\n", declared, opts.sampleFormat)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/go-audio/wav"
+)
+
+// readByteAt reads the byte whose start bit begins at frame i the way
+// assembleBytes does: a start bit, eight data bits, least significant first,
+// where anything that isn't a one is a zero, and two stop bits. It returns
+// false if the start or stop bits aren't there.
+func readByteAt(demod Demodulator, i int) (byte, bool) {
+	framesPerBit := demod.FramesPerBit()
+
+	if !demod.Zero(i) {
+		return 0, false
+	}
+
+	// like assembleBytes, look at the bit periods from the last frame of the
+	// start bit on
+	bitstreamIndex := i + framesPerBit - 1
+
+	var value byte
+
+	for _, mask := range BitMasks {
+		if demod.One(bitstreamIndex) {
+			value |= byte(mask)
+		}
+		bitstreamIndex += framesPerBit
+	}
+
+	for stop := 0; stop < 2; stop++ {
+		if !demod.One(bitstreamIndex) {
+			return 0, false
+		}
+		bitstreamIndex += framesPerBit
+	}
+
+	return value, true
+}
+
+// nextByteAt reads the byte that follows one ending at frame i, allowing for
+// a gap of up to two bit periods of stop bits before its start bit.
+func nextByteAt(demod Demodulator, i int) (byte, int, bool) {
+	for start := i; start <= i+2*demod.FramesPerBit(); start++ {
+		if value, ok := readByteAt(demod, start); ok {
+			return value, start, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// magicCandidate is a place in a recording where the magic byte is followed
+// by three program number digits.
+type magicCandidate struct {
+	Frame         int
+	ProgramNumber int
+}
+
+// findMagicCandidates returns every place in the recording the magic byte is
+// followed by three bytes that could be program number digits, whether or not
+// a sequence decodes from there.
+func findMagicCandidates(ctx context.Context, demod Demodulator) ([]magicCandidate, error) {
+	var (
+		candidates []magicCandidate
+		from       int
+	)
+
+	for {
+		candidate, ok, err := nextMagicCandidate(ctx, demod, from)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return candidates, nil
+		}
+
+		candidates = append(candidates, candidate)
+
+		// the start bit reads as a zero for a few frames either side of
+		// where it lines up, so skip past the magic byte rather than list
+		// it again
+		from = candidate.Frame + 11*demod.FramesPerBit()
+	}
+}
+
+// nextMagicCandidate returns the first place from frame from on that the
+// magic byte is followed by three bytes that could be program number digits,
+// and false if there isn't one.
+func nextMagicCandidate(ctx context.Context, demod Demodulator, from int) (magicCandidate, bool, error) {
+	framesPerBit := demod.FramesPerBit()
+
+	for i := from; i+11*framesPerBit <= demod.Len(); i++ {
+		if (i-from)%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return magicCandidate{}, false, err
+			}
+		}
+
+		if value, ok := readByteAt(demod, i); !ok || value != magicByte {
+			continue
+		}
+
+		digits := make([]int, 0, 3)
+		end := i + 11*framesPerBit
+
+		for len(digits) < 3 {
+			value, start, ok := nextByteAt(demod, end)
+			if !ok || value > 9 {
+				break
+			}
+
+			digits = append(digits, int(value))
+			end = start + 11*framesPerBit
+		}
+
+		if len(digits) < 3 {
+			continue
+		}
+
+		return magicCandidate{
+			Frame:         i,
+			ProgramNumber: digits[0]*100 + digits[1]*10 + digits[2],
+		}, true, nil
+	}
+
+	return magicCandidate{}, false, nil
+}
+
+// scanMagic prints every place in a wav file that looks like the start of a
+// sequence, for recordings that won't decode.
+func scanMagic(fileName string, opts decodeOptions) {
+	waveFile, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer waveFile.Close()
+
+	decoder := wav.NewDecoder(waveFile)
+	if err := checkWavFile(decoder); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	warnSampleFormat(decoder, opts)
+	warnDataChunk(waveFile)
+
+	if err := opts.checkRange(decoder); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	strategy := decodeStrategies[0]
+	signOpts := strategy.signChangeOptions(decoder, opts)
+
+	samples, err := readSamples(context.Background(), decoder, signOpts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, &signChangeError{err: err})
+		os.Exit(1)
+	}
+
+	rate := int(decoder.SampleRate)
+	signBits := signChangeBits(samples, opts.hysteresis, false)
+	demod := newDemodulator(opts.demod, samples, signBits, strategy.framesPerBit(rate), rate)
+
+	candidates, err := findMagicCandidates(context.Background(), demod)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(candidates) == 0 {
+		fmt.Println("no magic byte followed by a program number found")
+		return
+	}
+
+	for _, candidate := range candidates {
+		frame := signOpts.startFrame + candidate.Frame
+		fmt.Printf("frame %d (%.3fs, bit %d): program %03d\n", frame, float64(frame)/float64(rate), candidate.Frame/demod.FramesPerBit(), candidate.ProgramNumber)
+	}
+}
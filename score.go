@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/go-audio/wav"
+)
+
+// scoreFile decodes a wav file and compares it against a reference JSON file
+// of what it should hold, printing where they differ. It returns the share of
+// the reference's bytes that were decoded correctly, as a percentage. A
+// recording that doesn't decode at all scores 0.
+//
+// The bytes are compared whether or not they validate, so a decode that got
+// a single note wrong still scores close to 100. The notes are compared too,
+// for a mismatch that's easier to read than a byte offset.
+func scoreFile(fileName, referenceName string, opts decodeOptions) (float64, error) {
+	reference, err := opts.loadSequence(referenceName)
+	if err != nil {
+		return 0, err
+	}
+
+	want, err := opts.encodeSequence(reference, 0)
+	if err != nil {
+		return 0, fmt.Errorf("problem encoding the reference: %w", err)
+	}
+
+	waveFile, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer waveFile.Close()
+
+	decoder := wav.NewDecoder(waveFile)
+	if err := checkWavFile(decoder); err != nil {
+		return 0, err
+	}
+
+	result, err := generateWavBytes(context.Background(), decoder, opts)
+	if err != nil {
+		fmt.Println("decode failed:", err)
+		fmt.Printf("Accuracy: %.1f%%\n", 0.0)
+		return 0, nil
+	}
+
+	got := result.Bytes
+
+	var matches int
+
+	for i := 0; i < max(len(got), len(want)); i++ {
+		switch {
+		case i >= len(got):
+			fmt.Printf("byte %d: missing, want %02X\n", i, want[i])
+		case i >= len(want):
+			fmt.Printf("byte %d: got %02X, which the reference doesn't have\n", i, got[i])
+		case got[i] != want[i]:
+			fmt.Printf("byte %d: got %02X, want %02X\n", i, got[i], want[i])
+		default:
+			matches++
+		}
+	}
+
+	accuracy := 100 * float64(matches) / float64(max(len(got), len(want)))
+
+	fmt.Printf("Bytes: %d of %d match\n", matches, len(want))
+
+	if err := opts.validateBytes(got); err != nil {
+		fmt.Println("Validation:", err)
+	}
+
+	// partialSequence reads the notes without checking the checksums, so
+	// they can be compared even when the bytes don't validate
+	sequence, err := partialSequence(got)
+	if err != nil {
+		fmt.Println("Notes: couldn't be read:", err)
+	} else {
+		scoreNotes(1, sequence.Channel1Notes, reference.Channel1Notes)
+		scoreNotes(2, sequence.Channel2Notes, reference.Channel2Notes)
+	}
+
+	fmt.Printf("Accuracy: %.1f%%\n", accuracy)
+
+	return accuracy, nil
+}
+
+// scoreNotes prints how many of a channel's notes and bars match the
+// reference, and each that doesn't.
+func scoreNotes(channel int, got, want []NoteLine) {
+	var matches int
+
+	for i := 0; i < max(len(got), len(want)); i++ {
+		switch {
+		case i >= len(got):
+			fmt.Printf("channel %d, note %d: missing, want %s\n", channel, i, describeNoteLine(want[i]))
+		case i >= len(want):
+			fmt.Printf("channel %d, note %d: got %s, which the reference doesn't have\n", channel, i, describeNoteLine(got[i]))
+		case !got[i].Equal(want[i]):
+			fmt.Printf("channel %d, note %d: got %s, want %s\n", channel, i, describeNoteLine(got[i]), describeNoteLine(want[i]))
+		default:
+			matches++
+		}
+	}
+
+	fmt.Printf("Channel %d Notes: %d of %d match\n", channel, matches, len(want))
+}
+
+// describeNoteLine returns a line as a short description, such as "bar" or
+// "C#3 step 24 gate 12 accent".
+func describeNoteLine(n NoteLine) string {
+	if n.Bar {
+		return "bar"
+	}
+
+	description := fmt.Sprintf("%s step %d gate %d", noteMap[n.NoteNum], n.StepLength, n.GateLength)
+
+	if n.Portamento {
+		description += " portamento"
+	}
+
+	if n.Accent {
+		description += " accent"
+	}
+
+	return description
+}
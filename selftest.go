@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// runSelfTest runs the selftest subcommand, which needs no file, with the
+// arguments after its name:
+//
+//	mc-202-librarian selftest [-seed n]
+func runSelfTest(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	seedPtr := flags.Int64("seed", 0, "the seed for the random sequence, defaults to a random seed")
+
+	flags.Parse(args)
+
+	if flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "selftest doesn't take any arguments, only flags")
+		os.Exit(1)
+	}
+
+	seed := *seedPtr
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	if err := selfTest(seed, defaultEncodeOptions); err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL (seed %d): %v\n", seed, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("PASS (seed %d)\n", seed)
+}
+
+// selfTest generates a random sequence from the seed, encodes it to a wav file
+// in memory and decodes it again, returning an error if anything fails or the
+// decoded sequence doesn't match.
+func selfTest(seed int64, opts encodeOptions) error {
+	sequence := randomSequence(rand.New(rand.NewSource(seed)))
+
+	data, err := opts.encodeSequence(sequence, 0)
+	if err != nil {
+		return fmt.Errorf("problem encoding: %w", err)
+	}
+
+	var wavFile memFile
+
+	err = writeWavStreamTo(&wavFile, nil, func(write func([]int) error) error {
+		return streamSequenceSamples(data, opts, write)
+	})
+	if err != nil {
+		return fmt.Errorf("problem writing wav: %w", err)
+	}
+
+	decoded, err := Decode(bytes.NewReader(wavFile.data))
+	if err != nil {
+		return fmt.Errorf("problem decoding: %w", err)
+	}
+
+	if !decoded.Equal(sequence) {
+		return fmt.Errorf("decoded sequence doesn't match:\n%v\nexpected:\n%v", decoded, sequence)
+	}
+
+	return nil
+}
+
+// randomSequence returns a valid sequence with a random program number and a
+// few random notes and bars in one or both channels, or only in channel 2.
+func randomSequence(rng *rand.Rand) *Sequence {
+	sequence := &Sequence{
+		Header: Header{
+			ProgramNumber: rng.Intn(1000),
+			NumChannels:   1 + rng.Intn(2),
+		},
+		Channel1Notes: randomNotes(rng),
+	}
+
+	if sequence.NumChannels == 2 {
+		sequence.Channel2Notes = randomNotes(rng)
+
+		// now and then leave channel 1 empty, a pattern with only the
+		// second part
+		if rng.Intn(8) == 0 {
+			sequence.Channel1Notes = nil
+		}
+	}
+
+	return sequence
+}
+
+// randomNotes returns between one and 16 random notes, with the occasional
+// bar between them. Each gate is at most its step, as the MC-202 plays them.
+func randomNotes(rng *rand.Rand) []NoteLine {
+	var notes []NoteLine
+
+	for i := rng.Intn(16); i >= 0; i-- {
+		if rng.Intn(4) == 0 {
+			notes = append(notes, NoteLine{Bar: true})
+		}
+
+		noteNum := MinNote + rng.Intn(MaxNote-MinNote+1)
+		stepLength := MinStepLength + rng.Intn(MaxStepLength-MinStepLength+1)
+
+		notes = append(notes, NoteLine{
+			NoteNum:    noteNum,
+			NoteName:   noteMap[noteNum].NoteName,
+			Octave:     noteMap[noteNum].Octave,
+			StepLength: stepLength,
+			GateLength: MinGateLength + rng.Intn(stepLength-MinGateLength+1),
+			Portamento: rng.Intn(2) == 0,
+			Accent:     rng.Intn(2) == 0,
+		})
+	}
+
+	return notes
+}
+
+// memFile is an in-memory io.WriteSeeker, for writing a wav file without
+// touching the disk.
+type memFile struct {
+	data []byte
+	pos  int
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if end := f.pos + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+
+	n := copy(f.data[f.pos:], p)
+	f.pos += n
+
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(f.pos) + offset
+	case io.SeekEnd:
+		pos = int64(len(f.data)) + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	f.pos = int(pos)
+
+	return pos, nil
+}
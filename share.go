@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// shareCodePrefix starts every share code. The number after the name is the
+// version of the format, so the layout of what follows can change without old
+// codes being read the wrong way.
+const shareCodePrefix = "MC202:1:"
+
+// shareCode returns the bytes of a save as a single line of text that can be
+// pasted into a message: the prefix followed by the bytes, laid out as
+// described on parseBytes, in URL-safe base64. The bytes are validated first
+// so only good saves are shared.
+func shareCode(data []byte) (string, error) {
+	if _, err := checkBytes(data); err != nil {
+		return "", err
+	}
+
+	return shareCodePrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// parseShareCode returns the bytes of a save from a share code, checking the
+// prefix and that the bytes are a whole, valid save.
+func parseShareCode(code string) ([]byte, error) {
+	code = strings.TrimSpace(code)
+
+	if !strings.HasPrefix(code, shareCodePrefix) {
+		return nil, fmt.Errorf("%w: it should start with %s", ErrInvalidShareCode, shareCodePrefix)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(code, shareCodePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidShareCode, err)
+	}
+
+	if _, err := checkBytes(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidShareCode, err)
+	}
+
+	return data, nil
+}
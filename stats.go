@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// minLeaderBits is the number of consecutive one bits needed before a run of
+// them is treated as the leader tone rather than noise.
+const minLeaderBits = 100
+
+// findLeader returns the range of the bitstream, in frames, covered by the
+// leader tone: the first run of at least minLeaderBits one bits. It returns
+// 0, 0 if no leader is found.
+func findLeader(bits []int, framesPerBit int) (start, end int) {
+	var run int
+
+	for i := 0; i+framesPerBit <= len(bits); i += framesPerBit {
+		if sum(bits[i:i+framesPerBit]) >= 7 {
+			if run == 0 {
+				start = i
+			}
+			run++
+			continue
+		}
+
+		if run >= minLeaderBits {
+			return start, i
+		}
+
+		run = 0
+	}
+
+	if run >= minLeaderBits {
+		return start, start + run*framesPerBit
+	}
+
+	return 0, 0
+}
+
+// EstimateSNR estimates the signal to noise ratio of a recording from its
+// leader tone. Every bit period of a clean leader contains exactly one bit's
+// worth of one-frequency cycles, two sign changes per cycle; noise adds or
+// drops sign changes. The figure returned is the ratio of the ideal count to
+// the mean squared deviation from it, in dB. It returns 0 if no leader tone is
+// found and +Inf if the leader is perfectly clean.
+func EstimateSNR(bits []int, framesPerBit int) float64 {
+	start, end := findLeader(bits, framesPerBit)
+	if end == 0 {
+		return 0
+	}
+
+	ideal := float64(oneCycles * 2)
+
+	var (
+		noise   float64
+		windows int
+	)
+
+	for i := start; i+framesPerBit <= end; i += framesPerBit {
+		deviation := float64(sum(bits[i:i+framesPerBit])) - ideal
+		noise += deviation * deviation
+		windows++
+	}
+
+	noise /= float64(windows)
+
+	if noise == 0 {
+		return math.Inf(1)
+	}
+
+	return 10 * math.Log10(ideal*ideal/noise)
+}
+
+// Levels is how loud a recording is, as a fraction of full scale.
+type Levels struct {
+	Peak float64
+	RMS  float64
+}
+
+// measureLevels returns the peak and RMS levels of samples normalized to ±1.
+// A clean recording made at a sensible level peaks somewhere around -6 to
+// -1 dBFS; one that peaks at 0 dBFS has probably clipped.
+func measureLevels(samples []float64) *Levels {
+	var levels Levels
+
+	if len(samples) == 0 {
+		return &levels
+	}
+
+	var squares float64
+
+	for _, sample := range samples {
+		levels.Peak = math.Max(levels.Peak, math.Abs(sample))
+		squares += sample * sample
+	}
+
+	levels.RMS = math.Sqrt(squares / float64(len(samples)))
+
+	return &levels
+}
+
+// dBFS returns a level as a fraction of full scale in decibels, -Inf for
+// silence.
+func dBFS(level float64) float64 {
+	return 20 * math.Log10(level)
+}
+
+// programConfidence returns how likely it is, from 0 to 1, that the program
+// number was read from the start of a real save rather than from a false sync
+// on noise that happened to give three digits, along with the reasons for any
+// doubt. A real save's magic byte comes straight after its leader tone, and
+// its line counts and checksums add up; a false sync rarely manages either.
+func programConfidence(result *DecodeResult, opts decodeOptions) (float64, []string) {
+	var (
+		confidence float64
+		doubts     []string
+	)
+
+	framesPerBit := result.FramesPerBit
+
+	_, leaderEnd := findLeader(result.SignBits, framesPerBit)
+
+	// the magic byte is the first byte the decode assembled
+	offsets := result.Offsets
+
+	switch {
+	case len(offsets) == 0:
+		doubts = append(doubts, "the bytes weren't read from one place in the recording")
+	case leaderEnd == 0 || offsets[0]-leaderEnd > 2*framesPerBit || leaderEnd-offsets[0] > 2*framesPerBit:
+		doubts = append(doubts, "no leader tone right before the magic byte")
+	default:
+		confidence += 0.5
+	}
+
+	if err := opts.validateBytes(result.Bytes); err != nil {
+		doubts = append(doubts, "the line counts and checksums don't add up")
+	} else {
+		confidence += 0.5
+	}
+
+	return confidence, doubts
+}
+
+// printStats prints statistics about the quality of a decoded recording.
+func printStats(result *DecodeResult, opts decodeOptions) {
+	framesPerBit := result.FramesPerBit
+
+	start, end := findLeader(result.SignBits, framesPerBit)
+
+	fmt.Printf("Frames Per Bit: %d\n", framesPerBit)
+	fmt.Printf("Leader Tone: %.2fs\n", float64(end-start)/float64(result.SampleRate))
+	fmt.Printf("Estimated SNR: %.1f dB\n", EstimateSNR(result.SignBits, framesPerBit))
+	fmt.Printf("False Magic Bytes: %d\n", result.FalseMagicBytes)
+
+	confidence, doubts := programConfidence(result, opts)
+	fmt.Printf("Program Number Confidence: %.0f%%", confidence*100)
+	if len(doubts) > 0 {
+		fmt.Printf(" (%s)", strings.Join(doubts, ", "))
+	}
+	fmt.Println()
+
+	if result.Levels != nil {
+		fmt.Printf("Peak Level: %.3f (%.1f dBFS)\n", result.Levels.Peak, dBFS(result.Levels.Peak))
+		fmt.Printf("RMS Level: %.3f (%.1f dBFS)\n", result.Levels.RMS, dBFS(result.Levels.RMS))
+	}
+
+	fmt.Println()
+}
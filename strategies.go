@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/go-audio/wav"
+)
+
+// decodeStrategy is one way of getting from a wav file to the bytes it
+// contains. generateWavBytes tries them in the order they're listed in
+// decodeStrategies.
+type decodeStrategy struct {
+	name string
+	opts signChangeOptions
+	// framesPerBitNudge is added to the frames per bit for the sample rate.
+	framesPerBitNudge int
+}
+
+var decodeStrategies = []decodeStrategy{
+	{name: "default"},
+	{name: primedStrategyName, opts: signChangeOptions{prime: true}},
+	// a recording with its polarity inverted starts on the other side of
+	// zero, so its first sign change can be missed
+	{name: invertedStrategyName, opts: signChangeOptions{invert: true}},
+	// framesPerBitForRate rounds to the nearest frame, which can leave the
+	// bit periods a frame off for rates that don't divide evenly, or for
+	// decks that ran a little fast or slow
+	{name: "fpb-1", framesPerBitNudge: -1},
+	{name: "fpb+1", framesPerBitNudge: 1},
+	// the left channel of a stereo recording can have a dropout or a bad
+	// head the right doesn't, and both carry the same signal
+	{name: rightStrategyName, opts: signChangeOptions{channel: 1}},
+}
+
+// invertedStrategyName is the name of the strategy that reads the recording
+// with its polarity inverted.
+const invertedStrategyName = "inverted"
+
+// rightStrategyName is the name of the strategy that reads the second channel
+// of a stereo file.
+const rightStrategyName = "right"
+
+// applies reports whether the strategy can be used on the file, which it
+// can't if it reads a channel the file doesn't have.
+func (s decodeStrategy) applies(decoder *wav.Decoder) bool {
+	return s.opts.channel < int(decoder.NumChans)
+}
+
+// cueStrategyName is the name of the strategy generateWavBytes tries first
+// when the file has a cue marker.
+const cueStrategyName = "cue"
+
+// cueStart returns the frame of the earliest cue marker in the wav file, if
+// it has any. Archivists sometimes mark where the data starts, which lets us
+// skip the scan through whatever was recorded before it.
+func cueStart(decoder *wav.Decoder) (int, bool) {
+	decoder.ReadMetadata()
+	if decoder.Metadata == nil || len(decoder.Metadata.CuePoints) == 0 {
+		return 0, false
+	}
+
+	start := -1
+	for _, cue := range decoder.Metadata.CuePoints {
+		position := int(cue.Position)
+		if position == 0 {
+			position = int(cue.SampleOffset)
+		}
+
+		if start == -1 || position < start {
+			start = position
+		}
+	}
+
+	return start, start > 0
+}
+
+// primedStrategyName is the name of the strategy that drops the first buffer
+// of PCM data.
+const primedStrategyName = "primed"
+
+// firstBufferOutOfStep reports whether the first buffer of PCM data looks out
+// of step with the rest of the data chunk, the quirk the primed strategy gets
+// past, so it can be tried first rather than after a whole decode has failed.
+//
+// It reads the first two buffers and looks at the leader tone where they
+// meet. The tone's half cycles are all close to the same length, so if the
+// half cycle that spans the boundary is longer or shorter than every one
+// either side of it, the first buffer doesn't line up with the second. A file
+// that doesn't start in the leader tone, such as one that starts in silence,
+// is never reported, so it's decoded the way it always was.
+func firstBufferOutOfStep(ctx context.Context, decoder *wav.Decoder, opts decodeOptions) bool {
+	boundary := framesToRead / max(int(decoder.NumChans), 1)
+
+	samples, err := readSamples(ctx, decoder, signChangeOptions{
+		endFrame:     2 * boundary,
+		hysteresis:   opts.hysteresis,
+		sampleFormat: opts.sampleFormat,
+		buffers:      opts.buffers,
+	})
+	if err != nil || len(samples) < 2*boundary {
+		return false
+	}
+
+	defer opts.buffers.putSamples(samples)
+
+	var before, after []int
+
+	for i, bit := range signChangeBits(samples, opts.hysteresis, false) {
+		if bit != 1 {
+			continue
+		}
+
+		if i < boundary {
+			before = append(before, i)
+		} else {
+			after = append(after, i)
+		}
+	}
+
+	// there need to be enough half cycles either side to say how long they
+	// are
+	const minHalfCycles = 16
+
+	if len(before) <= minHalfCycles || len(after) <= minHalfCycles {
+		return false
+	}
+
+	halfCycle := float64(decoder.SampleRate) / (2 * oneFreq)
+	shortest, longest := math.MaxInt, 0
+
+	for _, changes := range [][]int{before[len(before)-minHalfCycles-1:], after[:minHalfCycles+1]} {
+		for i := 1; i < len(changes); i++ {
+			length := changes[i] - changes[i-1]
+
+			// anything else isn't the leader tone
+			if math.Abs(float64(length)-halfCycle) > 2 {
+				return false
+			}
+
+			shortest = min(shortest, length)
+			longest = max(longest, length)
+		}
+	}
+
+	spanning := after[0] - before[len(before)-1]
+
+	return spanning < shortest || spanning > longest
+}
+
+// signChangeError is returned by a decode strategy when the sign change bits
+// couldn't be read at all, as opposed to read but not assembled into bytes.
+type signChangeError struct {
+	err error
+}
+
+func (e *signChangeError) Error() string {
+	return fmt.Sprintf("problem generating sign change bits: %v", e.err)
+}
+
+func (e *signChangeError) Unwrap() error {
+	return e.err
+}
+
+// framesPerBit returns the number of frames per bit the strategy decodes a
+// recording at rate with.
+func (s decodeStrategy) framesPerBit(rate int) int {
+	return framesPerBitForRate(rate) + s.framesPerBitNudge
+}
+
+// signChangeOptions combines the strategy's options with the decode options.
+// A time range to decode takes precedence over where the strategy starts.
+func (s decodeStrategy) signChangeOptions(decoder *wav.Decoder, opts decodeOptions) signChangeOptions {
+	signOpts := s.opts
+	signOpts.hysteresis = opts.hysteresis
+	signOpts.sampleFormat = opts.sampleFormat
+	signOpts.buffers = opts.buffers
+
+	start, end := opts.frameRange(decoder)
+	if start > 0 {
+		signOpts.startFrame = start
+	}
+	signOpts.endFrame = end
+
+	return signOpts
+}
+
+// decode reads the sign change bits from the wav file and assembles them into
+// bytes. The result holds the sign change bits, the bytes, where they were
+// read from and the levels of the samples, the caller fills in the rest.
+func (s decodeStrategy) decode(ctx context.Context, decoder *wav.Decoder, opts decodeOptions) (*DecodeResult, error) {
+	signOpts := s.signChangeOptions(decoder, opts)
+
+	start := time.Now()
+
+	samples, err := readSamples(ctx, decoder, signOpts)
+
+	opts.profile.since(profileRead, start)
+
+	if err != nil {
+		return nil, &signChangeError{err: err}
+	}
+
+	// the result doesn't keep the samples, only what's worked out from them
+	defer opts.buffers.putSamples(samples)
+
+	return s.decodeSamples(ctx, samples, int(decoder.SampleRate), opts)
+}
+
+// decodeSamples assembles the bytes in samples recorded at rate, which have
+// already been read with the strategy's options.
+func (s decodeStrategy) decodeSamples(ctx context.Context, samples []float64, rate int, opts decodeOptions) (*DecodeResult, error) {
+	start := time.Now()
+
+	signBits := signChangeBits(samples, opts.hysteresis, s.opts.invert)
+
+	opts.profile.since(profileSignChange, start)
+	start = time.Now()
+
+	tunable := newDemodulator(opts.demod, samples, signBits, s.framesPerBit(rate), rate)
+
+	var demod Demodulator = tunable
+	if opts.adaptiveClock {
+		demod = newAdaptiveClock(tunable, signBits, rate)
+	}
+
+	bytes, offsets, falseMagicBytes, err := assembleBytesStats(ctx, demod, 0, opts)
+
+	opts.profile.since(profileAssembly, start)
+	opts.profile.attempt(len(samples), len(signBits), len(bytes))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &DecodeResult{SignBits: signBits, Bytes: bytes, Offsets: offsets, Levels: measureLevels(samples), FalseMagicBytes: falseMagicBytes}, nil
+}
+
+// compareStrategies decodes a wav file with every decode strategy and prints
+// which of them produced valid checksums and whether their bytes agree.
+func compareStrategies(fileName string, opts decodeOptions) {
+	waveFile, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer waveFile.Close()
+
+	decoder := wav.NewDecoder(waveFile)
+	if err := checkWavFile(decoder); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	warnSampleFormat(decoder, opts)
+	warnDataChunk(waveFile)
+
+	var reference []byte
+
+	for _, strategy := range decodeStrategies {
+		if !strategy.applies(decoder) {
+			continue
+		}
+
+		result, err := strategy.decode(context.Background(), decoder, opts)
+		if err != nil {
+			fmt.Printf("%-12s failed: %v\n", strategy.name, err)
+			continue
+		}
+
+		data := result.Bytes
+
+		valid := "valid"
+		if err := opts.validateBytes(data); err != nil {
+			valid = err.Error()
+		}
+
+		agreement := "reference"
+		if reference == nil {
+			reference = data
+		} else if bytes.Equal(reference, data) {
+			agreement = "matches reference"
+		} else {
+			agreement = "differs from reference"
+		}
+
+		fmt.Printf("%-12s %d bytes, %s, %s\n", strategy.name, len(data), valid, agreement)
+	}
+}
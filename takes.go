@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/go-audio/wav"
+)
+
+// Take is one sequence found in a recording.
+type Take struct {
+	Bytes []byte
+	// Start is the index into the bitstream of the magic byte's start bit.
+	Start int
+	// End is the index into the bitstream just after the last byte.
+	End int
+}
+
+// DecodeAll assembles every sequence in the bitstream, in the order they were
+// recorded. Takes are returned whether or not their checksums are valid, and
+// takes that don't assemble at all are left out.
+func DecodeAll(ctx context.Context, bits []int, framesPerBit int) ([]Take, error) {
+	return decodeAll(ctx, bits, framesPerBit, defaultDecodeOptions)
+}
+
+// decodeAll is DecodeAll with the stop bit tolerance and false magic byte
+// limit of opts.
+func decodeAll(ctx context.Context, bits []int, framesPerBit int, opts decodeOptions) ([]Take, error) {
+	var (
+		takes []Take
+		pos   int
+	)
+
+	demod := newSignChangeDemodulator(bits, framesPerBit)
+
+	for pos+framesPerBit < len(bits) {
+		data, offsets, _, err := assembleBytesStats(ctx, demod, pos, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			// a take that doesn't decode, with a dropout in its data buffer
+			// say, is skipped from its magic byte on so the takes after it
+			// are still found. Without another magic byte there are no more
+			// takes.
+			candidate, ok, err := nextMagicCandidate(ctx, demod, pos)
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				break
+			}
+
+			pos = candidate.Frame + 11*framesPerBit
+
+			continue
+		}
+
+		take := Take{
+			Bytes: data,
+			Start: offsets[0],
+			End:   offsets[len(offsets)-1] + 11*framesPerBit,
+		}
+
+		takes = append(takes, take)
+
+		pos = take.End
+	}
+
+	return takes, nil
+}
+
+// reconcileTakes decodes every take in the result's bitstream and majority
+// votes each byte across the takes that claim the same program number as the
+// first, printing how well the takes agreed.
+func reconcileTakes(result *DecodeResult, opts decodeOptions) ([]byte, error) {
+	framesPerBit := result.FramesPerBit
+
+	takes, err := decodeAll(context.Background(), result.SignBits, framesPerBit, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(takes) == 0 {
+		return nil, fmt.Errorf("no takes found")
+	}
+
+	program := takes[0].Bytes[1:4]
+
+	// the takes of the same program, keeping only those of the most common
+	// length since bytes can only be compared position by position
+	lengths := make(map[int]int)
+
+	var matching []Take
+
+	for i, take := range takes {
+		valid := "valid"
+		if err := opts.validateBytes(take.Bytes); err != nil {
+			valid = err.Error()
+		}
+
+		logf("Take %d: %.2fs, program %d%d%d, %d bytes, %s\n", i+1, float64(result.StartFrame+take.Start)/float64(result.SampleRate), take.Bytes[1], take.Bytes[2], take.Bytes[3], len(take.Bytes), valid)
+
+		if bytes.Equal(take.Bytes[1:4], program) {
+			matching = append(matching, take)
+			lengths[len(take.Bytes)]++
+		}
+	}
+
+	var length int
+
+	for l, count := range lengths {
+		if count > lengths[length] || (count == lengths[length] && l > length) {
+			length = l
+		}
+	}
+
+	var votes [][]byte
+
+	for _, take := range matching {
+		if len(take.Bytes) == length {
+			votes = append(votes, take.Bytes)
+		}
+	}
+
+	reconciled := make([]byte, length)
+
+	var disagreements int
+
+	for i := range reconciled {
+		counts := make(map[byte]int)
+
+		for _, take := range votes {
+			counts[take[i]]++
+		}
+
+		var (
+			best      byte
+			bestCount int
+		)
+
+		for b, count := range counts {
+			if count > bestCount || (count == bestCount && b < best) {
+				best, bestCount = b, count
+			}
+		}
+
+		reconciled[i] = best
+
+		if bestCount != len(votes) {
+			disagreements++
+			logf("Byte %d: %d of %d takes agree on %02X\n", i, bestCount, len(votes), best)
+		}
+	}
+
+	logf("Reconciled %d takes, %d of %d bytes unanimous\n", len(votes), length-disagreements, length)
+	logln()
+
+	return reconciled, nil
+}
+
+// readTakes reads the sign change bits of a wav file with the default
+// strategy without assembling them, for reconcileTakes to decode take by take
+// when the recording doesn't decode as a whole.
+func readTakes(ctx context.Context, decoder *wav.Decoder, opts decodeOptions) (*DecodeResult, error) {
+	if err := opts.checkRange(decoder); err != nil {
+		return nil, err
+	}
+
+	strategy := decodeStrategies[0]
+	signOpts := strategy.signChangeOptions(decoder, opts)
+
+	samples, err := readSamples(ctx, decoder, signOpts)
+	if err != nil {
+		return nil, &signChangeError{err: err}
+	}
+	defer opts.buffers.putSamples(samples)
+
+	rate := int(decoder.SampleRate)
+
+	return &DecodeResult{
+		SignBits:     signChangeBits(samples, opts.hysteresis, false),
+		Strategy:     strategy.name,
+		SampleRate:   rate,
+		FramesPerBit: strategy.framesPerBit(rate),
+		StartFrame:   signOpts.startFrame,
+		Levels:       measureLevels(samples),
+	}, nil
+}
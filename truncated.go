@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// recoveredLines returns the number of lines in the bytes read from a
+// recording that was cut off, laid out as described on parseBytes.
+func recoveredLines(data []byte) int {
+	if len(data) < 6 {
+		return 0
+	}
+
+	channel1LineCount := lineCountAt(data, 4)
+
+	lines := min(len(data)-6, channel1LineCount)
+
+	if channel2Start := 6 + channel1LineCount + 3; len(data) > channel2Start {
+		lines += len(data) - channel2Start
+	}
+
+	return lines
+}
+
+// partialSequence parses the bytes read from a recording that was cut off
+// into a Sequence of the whole notes and bars that were read. A note missing
+// any of its three lines is left out. The line counts are those of the notes
+// that were recovered, and the checksums are left empty since the bytes they
+// cover weren't all read.
+func partialSequence(data []byte) (*Sequence, error) {
+	if len(data) < 6 {
+		return nil, fmt.Errorf("%w: %d", ErrTooFewBytes, len(data))
+	}
+
+	sequence := Sequence{
+		Header: Header{
+			MagicByte:     data[0],
+			ProgramNumber: programNumber(data),
+			NumChannels:   1,
+		},
+	}
+
+	channel1LineCount := lineCountAt(data, 4)
+
+	sequence.Channel1Notes = partialLines(data[6:min(len(data), 6+channel1LineCount)])
+
+	if channel2Start := 6 + channel1LineCount + 3; len(data) > channel2Start {
+		sequence.Channel2Notes = partialLines(data[channel2Start:])
+	}
+
+	for i, notes := range [][]NoteLine{sequence.Channel1Notes, sequence.Channel2Notes} {
+		if err := checkNoteLines(i+1, notes); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(sequence.Channel2Notes) > 0 {
+		sequence.NumChannels = 2
+	}
+
+	sequence.Channel1LineCount = lineCount(sequence.Channel1Notes)
+	sequence.Channel2LineCount = sequence.Channel1LineCount + lineCount(sequence.Channel2Notes)
+	sequence.Channel2AdjustedLineCount = lineCount(sequence.Channel2Notes)
+
+	return &sequence, nil
+}
+
+// partialLines parses a channel's lines into notes and bars, stopping at a
+// note that doesn't have all three of its lines.
+func partialLines(lines []byte) []NoteLine {
+	var notes []NoteLine
+
+	for i := 0; i < len(lines); i++ {
+		if lines[i] == barByte {
+			notes = append(notes, NoteLine{Bar: true})
+			continue
+		}
+
+		if i+3 > len(lines) {
+			break
+		}
+
+		noteNum := int(lines[i+2] & noteNumMask)
+
+		notes = append(notes, NoteLine{
+			NoteNum:    noteNum,
+			NoteName:   noteMap[noteNum].NoteName,
+			Octave:     noteMap[noteNum].Octave,
+			StepLength: int(lines[i]),
+			GateLength: int(lines[i+1]),
+			Portamento: lines[i+2]&portamentoMask != 0,
+			Accent:     lines[i+2]&accentMask != 0,
+		})
+
+		i += 2
+	}
+
+	return notes
+}
+
+// writePartial writes the notes read from a recording that was cut off to a
+// json file if -partial was given, or says how to otherwise.
+func writePartial(fileName string, truncated *TruncatedError, opts decodeOptions) {
+	if !opts.partial {
+		fmt.Fprintln(os.Stderr, "the recording looks to be cut off rather than corrupt, use -partial to keep the notes that were read")
+		return
+	}
+
+	sequence, err := partialSequence(truncated.Bytes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "problem parsing the notes that were read:", err)
+		return
+	}
+
+	if err := opts.writeJSON(fileName, sequence); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "wrote the notes and bars that were read, %d of them, to %s\n", len(sequence.Channel1Notes)+len(sequence.Channel2Notes), fileName)
+}
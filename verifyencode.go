@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/go-audio/wav"
+)
+
+// verifyEncoding encodes data to a wav file in memory and decodes it again,
+// returning the wav file if it decodes to the same bytes. If it doesn't, the
+// error says where the decoded bytes first differ, so an encoder problem is
+// caught before it's written to a tape.
+func verifyEncoding(data []byte, opts encodeOptions, metadata *wav.Metadata) ([]byte, error) {
+	var wavFile memFile
+
+	err := writeWavStreamTo(&wavFile, metadata, func(write func([]int) error) error {
+		return streamSequenceSamples(data, opts, write)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := wav.NewDecoder(bytes.NewReader(wavFile.data))
+
+	result, err := generateWavBytes(context.Background(), decoder, defaultDecodeOptions)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncodeMismatch, err)
+	}
+
+	got := result.Bytes
+
+	for i := 0; i < min(len(got), len(data)); i++ {
+		if got[i] != data[i] {
+			return nil, fmt.Errorf("%w: byte %d decoded as %02X instead of %02X", ErrEncodeMismatch, i, got[i], data[i])
+		}
+	}
+
+	if len(got) != len(data) {
+		return nil, fmt.Errorf("%w: decoded %d bytes instead of %d", ErrEncodeMismatch, len(got), len(data))
+	}
+
+	return wavFile.data, nil
+}
+
+// writeVerifiedWav writes a save's bytes to a wav file once verifyEncoding
+// has checked they decode, so nothing is written if they don't.
+func writeVerifiedWav(fileName string, data []byte, opts encodeOptions, metadata *wav.Metadata) error {
+	wavData, err := verifyEncoding(data, opts, metadata)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, wavData, 0644)
+}